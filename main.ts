@@ -1,8 +1,83 @@
-import { HOSTNAME, PASSWORD, PORT } from "./src/env.ts";
+import config from "./deno.json" with { type: "json" };
+import { runCtl } from "./src/ctl.ts";
+import { HOSTNAME, PASSWORD, PORT, REUSE_PORT } from "./src/env.ts";
 import { handler } from "./src/handler.ts";
+import { runBench } from "./src/bench.ts";
+import { recoverJournal } from "./src/journal.ts";
+import { watchLogFile } from "./src/log.ts";
+import { runMockClient } from "./src/mockclient.ts";
+import { loadPlugins } from "./src/plugins.ts";
+import { runProxyClient } from "./src/proxyclient.ts";
+import { runReplay } from "./src/record.ts";
+import { protocolSchema } from "./src/schema.ts";
+import { runAsService } from "./src/shutdown.ts";
+import { runStatus } from "./src/status.ts";
+import { startUsageDump } from "./src/usage.ts";
 
-Deno.serve(
-  { hostname: HOSTNAME, port: Number.parseInt(PORT) },
-  handler,
-);
-if (PASSWORD) console.log(`Password: ${PASSWORD}`);
+const USAGE = `Usage: main.ts [command] [options]
+
+Commands:
+  serve       run the server (the default)
+  client      connect as a proxy client forwarding to an upstream URL
+  mockclient  connect as a mock proxy client, see "Mock client" in the README
+  status      print a running server's admin stats
+  ctl         manage a running server through the admin API
+  bench       load test a running server
+  replay      replay recorded requests
+  protocol    print the protocol's JSON Schema (--json-schema)
+  version     print the version`;
+
+async function serve() {
+  recoverJournal();
+  await loadPlugins();
+  const server = Deno.serve(
+    { hostname: HOSTNAME, port: Number.parseInt(PORT), reusePort: REUSE_PORT },
+    handler,
+  );
+  runAsService(server);
+  watchLogFile();
+  startUsageDump();
+  if (PASSWORD) console.log(`Password: ${PASSWORD}`);
+}
+
+switch (Deno.args[0]) {
+  case undefined:
+  case "serve":
+    await serve();
+    break;
+  case "bench":
+    await runBench(Deno.args.slice(1));
+    break;
+  case "client":
+    await runProxyClient(Deno.args.slice(1));
+    break;
+  case "mockclient":
+    await runMockClient(Deno.args.slice(1));
+    break;
+  case "protocol":
+    if (Deno.args[1] !== "--json-schema") {
+      console.error("Usage: main.ts protocol --json-schema");
+      Deno.exit(1);
+    }
+    console.log(JSON.stringify(protocolSchema, null, 2));
+    break;
+  case "replay":
+    await runReplay(Deno.args.slice(1));
+    break;
+  case "ctl":
+    await runCtl(Deno.args.slice(1));
+    break;
+  case "status":
+    await runStatus(Deno.args.slice(1));
+    break;
+  case "version":
+    console.log(config.version);
+    break;
+  case "help":
+  case "--help":
+    console.log(USAGE);
+    break;
+  default:
+    console.error(USAGE);
+    Deno.exit(1);
+}
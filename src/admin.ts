@@ -0,0 +1,269 @@
+import { audit } from "./audit.ts";
+import { CaptureRules, getCaptureRules, setCaptureRules } from "./capture.ts";
+import { dashboardHtml } from "./dashboard.ts";
+import {
+  DebugLogRules,
+  getDebugLogRules,
+  setDebugLogRules,
+} from "./debuglog.ts";
+import { getDispatcher } from "./dispatcher.ts";
+import { interruptedRequests } from "./journal.ts";
+import { getLogLevels, setLogLevels } from "./log.ts";
+import { inMaintenance, setMaintenance } from "./maintenance.ts";
+import { renderMetrics } from "./metrics.ts";
+import {
+  addRoute,
+  deleteRoute,
+  listRoutes,
+  reloadRoutes,
+  replaceRoute,
+  Route,
+  routeError,
+} from "./routes.ts";
+import { tailSnapshot, tailStream } from "./tail.ts";
+import { listTokens, mintToken, revokeToken } from "./tokens.ts";
+import { ClientConfig } from "./types.ts";
+import { resetUsage, usageCsv, usageReport } from "./usage.ts";
+import { filterPath } from "./wasm.ts";
+
+const startedAt = Date.now();
+
+/**
+ * Handles requests under the admin path. `route` is the part of the path
+ * after the admin prefix, e.g. "/capture". Requests other than GETs are
+ * recorded in the audit log as performed by `actor`, whether they succeed
+ * or not.
+ */
+export async function adminHandler(
+  req: Request,
+  route: string,
+  url: URL,
+  actor: string,
+): Promise<Response> {
+  let params: unknown;
+  if (req.method !== "GET") {
+    try {
+      const text = await req.text();
+      params = text ? JSON.parse(text) : undefined;
+    } catch {
+      await audit(actor, `${req.method} ${route}`, undefined, 400);
+      return new Response("Invalid JSON body", { status: 400 });
+    }
+  }
+
+  const response = await handleRoute(req.method, route, url, params);
+  if (req.method !== "GET") {
+    await audit(actor, `${req.method} ${route}`, params, response.status);
+  }
+  return response;
+}
+
+function tailFilter(url: URL) {
+  return {
+    path: url.searchParams.get("path") ?? undefined,
+    clientId: url.searchParams.get("client") ?? undefined,
+  };
+}
+
+async function handleRoute(
+  method: string,
+  route: string,
+  url: URL,
+  params: unknown,
+): Promise<Response> {
+  if (method === "DELETE" && route.startsWith("/tokens/")) {
+    const id = route.slice("/tokens/".length);
+    if (!(await revokeToken(id))) {
+      return new Response("Not Found", { status: 404 });
+    }
+    getDispatcher().disconnectToken(id);
+    return new Response(null, { status: 204 });
+  }
+
+  switch (`${method} ${route}`) {
+    case "GET /dashboard":
+      return new Response(dashboardHtml, {
+        headers: { "content-type": "text/html; charset=utf-8" },
+      });
+
+    case "GET /requests":
+      return Response.json(tailSnapshot(tailFilter(url)));
+
+    case "GET /requests/stream":
+      return new Response(tailStream(tailFilter(url)), {
+        headers: {
+          "content-type": "text/event-stream",
+          "cache-control": "no-cache",
+        },
+      });
+
+    case "POST /flush-pools": {
+      const { host } = (params ?? {}) as { host?: string };
+      if (!(await getDispatcher().flushPools(host))) {
+        return new Response("Proxy client not connected", { status: 503 });
+      }
+      return new Response(null, { status: 204 });
+    }
+
+    case "GET /client-config":
+      return Response.json(getDispatcher().configStatus);
+
+    case "POST /client-config": {
+      const push = await getDispatcher().pushConfig(params as ClientConfig);
+      if (!push) {
+        return new Response("Proxy client not connected", { status: 503 });
+      }
+      return Response.json(push, { status: 202 });
+    }
+
+    case "GET /journal":
+      return Response.json(interruptedRequests());
+
+    case "GET /metrics": {
+      const stats = getDispatcher().stats();
+      return new Response(
+        renderMetrics({
+          connected: stats.connected ? 1 : 0,
+          pending_requests: stats.pendingRequests,
+          queued_requests: stats.queuedRequests,
+          shed_requests: stats.shedRequests,
+          buffered_bytes: stats.bufferedBytes,
+        }),
+        { headers: { "content-type": "text/plain; version=0.0.4" } },
+      );
+    }
+
+    case "POST /client/kick":
+    case "POST /client/drain": {
+      const done = route === "/client/kick"
+        ? getDispatcher().kick()
+        : getDispatcher().drain();
+      if (!done) {
+        return new Response("Proxy client not connected", { status: 503 });
+      }
+      return new Response(null, { status: 204 });
+    }
+
+    case "GET /maintenance":
+      return Response.json({ enabled: inMaintenance() });
+
+    case "PUT /maintenance": {
+      const { enabled } = (params ?? {}) as { enabled?: boolean };
+      if (typeof enabled !== "boolean") {
+        return new Response("Missing enabled flag", { status: 400 });
+      }
+      setMaintenance(enabled);
+      return Response.json({ enabled });
+    }
+
+    case "POST /reload":
+      try {
+        reloadRoutes();
+      } catch (error) {
+        return new Response(`Failed to reload routes: ${error}`, {
+          status: 500,
+        });
+      }
+      return Response.json(listRoutes());
+
+    case "GET /routes":
+      return Response.json(listRoutes());
+
+    case "POST /routes":
+    case "PUT /routes": {
+      const error = routeError(params);
+      if (error) return new Response(error, { status: 400 });
+      const route = params as Route;
+      if (route.wasmFilter !== undefined && !filterPath(route.wasmFilter)) {
+        return new Response("wasmFilter must be inside WASM_FILTER_DIR", {
+          status: 400,
+        });
+      }
+      if (method === "POST") {
+        if (!(await addRoute(route))) {
+          return new Response("Route exists", { status: 409 });
+        }
+        return Response.json(route, { status: 201 });
+      }
+      if (!(await replaceRoute(route))) {
+        return new Response("Not Found", { status: 404 });
+      }
+      return Response.json(route);
+    }
+
+    case "DELETE /routes":
+      if (
+        !(await deleteRoute(
+          url.searchParams.get("prefix") ?? "",
+          url.searchParams.get("host") ?? undefined,
+        ))
+      ) {
+        return new Response("Not Found", { status: 404 });
+      }
+      return new Response(null, { status: 204 });
+
+    case "GET /stats": {
+      const { rss, heapUsed, heapTotal } = Deno.memoryUsage();
+      return Response.json({
+        uptime: (Date.now() - startedAt) / 1000,
+        ...getDispatcher().stats(),
+        memory: { rss, heapUsed, heapTotal },
+      });
+    }
+
+    case "GET /usage":
+      if (url.searchParams.get("format") === "csv") {
+        return new Response(usageCsv(), {
+          headers: { "content-type": "text/csv" },
+        });
+      }
+      return Response.json(usageReport());
+
+    case "POST /usage/reset":
+      resetUsage();
+      return Response.json(usageReport());
+
+    case "GET /log-levels":
+      return Response.json(getLogLevels());
+
+    case "PUT /log-levels":
+      try {
+        setLogLevels(params as Parameters<typeof setLogLevels>[0]);
+      } catch (error) {
+        return new Response(String(error), { status: 400 });
+      }
+      return Response.json(getLogLevels());
+
+    case "GET /debug-log":
+      return Response.json(getDebugLogRules());
+
+    case "PUT /debug-log":
+      try {
+        setDebugLogRules((params ?? {}) as Partial<DebugLogRules>);
+      } catch (error) {
+        return new Response(String(error), { status: 400 });
+      }
+      return Response.json(getDebugLogRules());
+
+    case "GET /tokens":
+      return Response.json(listTokens());
+
+    case "POST /tokens": {
+      const { label, ttl } = (params ?? {}) as { label?: string; ttl?: number };
+      return Response.json(await mintToken(label, ttl), { status: 201 });
+    }
+
+    case "GET /capture":
+      return Response.json(getCaptureRules());
+
+    case "PUT /capture":
+      try {
+        setCaptureRules((params ?? {}) as Partial<CaptureRules>);
+      } catch (error) {
+        return new Response(String(error), { status: 400 });
+      }
+      return Response.json(getCaptureRules());
+  }
+
+  return new Response("Not Found", { status: 404 });
+}
@@ -0,0 +1,34 @@
+import { AUDIT_LOG_FILE } from "./env.ts";
+import { createLogger } from "./log.ts";
+
+// Audit records are written whatever LOG_LEVEL and LOG_LEVELS say.
+const log = createLogger("audit", true);
+
+/**
+ * Records an admin call and the status it was answered with. It is always
+ * logged, and appended to AUDIT_LOG_FILE as a JSON line when that is set.
+ */
+export async function audit(
+  actor: string,
+  action: string,
+  params: unknown,
+  status: number,
+) {
+  log.info(`Admin action by ${actor}: ${action} (${status})`);
+  if (!AUDIT_LOG_FILE) return;
+
+  const entry = {
+    time: new Date().toISOString(),
+    actor,
+    action,
+    params,
+    status,
+  };
+  try {
+    await Deno.writeTextFile(AUDIT_LOG_FILE, JSON.stringify(entry) + "\n", {
+      append: true,
+    });
+  } catch (error) {
+    log.error("Failed to write audit log:", error);
+  }
+}
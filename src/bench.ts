@@ -0,0 +1,153 @@
+import { parseArgs } from "@std/cli/parse-args";
+import {
+  connectClient,
+  negotiateCapabilities,
+  sendResponse,
+} from "./client.ts";
+import { HOSTNAME, PASSWORD, PORT } from "./env.ts";
+
+function percentile(sorted: number[], q: number): number {
+  if (sorted.length === 0) return 0;
+  return sorted[Math.min(sorted.length - 1, Math.floor(q * sorted.length))];
+}
+
+interface LoadResult {
+  elapsed: number; // Seconds
+  latencies: number[]; // Milliseconds, sorted
+  received: number; // Bytes
+  errors: number;
+}
+
+/**
+ * Sends `total` GET requests to `url` from `concurrency` workers.
+ */
+async function load(
+  url: URL,
+  total: number,
+  concurrency: number,
+): Promise<LoadResult> {
+  const latencies: number[] = [];
+  let errors = 0;
+  let received = 0;
+  let issued = 0;
+
+  const worker = async () => {
+    while (issued < total) {
+      issued++;
+      const start = performance.now();
+      try {
+        const res = await fetch(url);
+        const bytes = (await res.arrayBuffer()).byteLength;
+        if (res.ok) received += bytes;
+        else errors++;
+      } catch {
+        errors++;
+      }
+      latencies.push(performance.now() - start);
+    }
+  };
+
+  const start = performance.now();
+  await Promise.all(Array.from({ length: concurrency }, worker));
+  const elapsed = (performance.now() - start) / 1000;
+  latencies.sort((a, b) => a - b);
+  return { elapsed, latencies, received, errors };
+}
+
+function report(total: number, result: LoadResult) {
+  const { elapsed, latencies, received, errors } = result;
+  console.log(`Duration:    ${elapsed.toFixed(2)}s`);
+  console.log(`Throughput:  ${(total / elapsed).toFixed(1)} req/s`);
+  console.log(
+    `Bandwidth:   ${(received / elapsed / 1024 / 1024).toFixed(2)} MiB/s`,
+  );
+  console.log(
+    `Latency:     p50 ${percentile(latencies, 0.5).toFixed(1)}ms, ` +
+      `p90 ${percentile(latencies, 0.9).toFixed(1)}ms, ` +
+      `p99 ${percentile(latencies, 0.99).toFixed(1)}ms`,
+  );
+  console.log(
+    `Errors:      ${errors} (${(errors / total * 100).toFixed(2)}%)`,
+  );
+}
+
+/**
+ * Runs a load test against a running server. The server only keeps one
+ * proxy client at a time, so a single in-process client is connected and
+ * a pool of concurrent HTTP workers is pointed at the public side of the
+ * tunnel. With --baseline, the same load is also sent straight to a local
+ * HTTP server serving the same body, to show what the tunnel costs.
+ */
+export async function runBench(args: string[]) {
+  const flags = parseArgs(args, {
+    string: ["target", "password", "requests", "concurrency", "size", "chunk"],
+    boolean: ["binary", "baseline"],
+    default: {
+      target: `http://${HOSTNAME}:${PORT}`,
+      password: PASSWORD ?? "",
+      requests: "1000",
+      concurrency: "16",
+      size: "1024",
+      chunk: "16384",
+    },
+  });
+  const total = Number.parseInt(flags.requests);
+  const concurrency = Number.parseInt(flags.concurrency);
+  const body = "x".repeat(Number.parseInt(flags.size));
+  const chunkSize = Number.parseInt(flags.chunk);
+
+  let binaryFrames = false;
+  const socket = await connectClient(
+    flags.target,
+    flags.password,
+    (client, request) =>
+      sendResponse(
+        client,
+        request.uuid,
+        { status: 200, headers: { "content-type": "text/plain" }, body },
+        chunkSize,
+        binaryFrames,
+      ),
+  );
+  if (flags.binary) {
+    const agreed = await negotiateCapabilities(socket, {
+      binaryFrames: true,
+      maxChunkSize: chunkSize,
+    });
+    binaryFrames = !!agreed.binaryFrames;
+    if (!binaryFrames) console.log("Server declined binary frames.");
+  }
+
+  const tunnel = await load(
+    new URL("/__bench", flags.target),
+    total,
+    concurrency,
+  );
+  socket.close();
+
+  console.log(
+    `Requests:    ${total} (${concurrency} concurrent` +
+      `${binaryFrames ? ", binary frames" : ""})`,
+  );
+  report(total, tunnel);
+  if (!flags.baseline) return;
+
+  const direct = Deno.serve(
+    { hostname: "127.0.0.1", port: 0, onListen: () => {} },
+    () => new Response(body, { headers: { "content-type": "text/plain" } }),
+  );
+  const baseline = await load(
+    new URL(`http://127.0.0.1:${direct.addr.port}/__bench`),
+    total,
+    concurrency,
+  );
+  await direct.shutdown();
+
+  console.log("\nDirect connection:");
+  report(total, baseline);
+  console.log(
+    `\nThe tunnel reached ` +
+      `${(baseline.elapsed / tunnel.elapsed * 100).toFixed(1)}% ` +
+      "of the direct throughput.",
+  );
+}
@@ -0,0 +1,75 @@
+import { ProxyMessageUnion } from "./types.ts";
+
+/**
+ * A protocol message on its way to a client.
+ */
+export interface Envelope {
+  clientId: string;
+  message: ProxyMessageUnion;
+}
+
+export type EnvelopeHandler = (envelope: Envelope) => void | Promise<void>;
+
+/**
+ * Publish/subscribe transport between the manager, which dispatches
+ * messages, and the connections that deliver them to clients. Backends like
+ * Redis, NATS or Kafka can implement it to carry envelopes between
+ * processes.
+ */
+export interface Bus {
+  /**
+   * Delivers an envelope to the topic's subscribers, resolving once they
+   * have handled it.
+   */
+  publish(topic: string, envelope: Envelope): Promise<void>;
+
+  /**
+   * Calls `handler` for every envelope published to `topic` until the
+   * returned function is called.
+   */
+  subscribe(topic: string, handler: EnvelopeHandler): () => void;
+}
+
+/**
+ * The default bus, within the process.
+ */
+export class LocalBus implements Bus {
+  private handlers = new Map<string, Set<EnvelopeHandler>>();
+
+  async publish(topic: string, envelope: Envelope) {
+    for (const handler of this.handlers.get(topic) ?? []) {
+      await handler(envelope);
+    }
+  }
+
+  subscribe(topic: string, handler: EnvelopeHandler) {
+    const handlers = this.handlers.get(topic) ?? new Set();
+    this.handlers.set(topic, handlers);
+    handlers.add(handler);
+    return () => {
+      handlers.delete(handler);
+      if (handlers.size === 0) this.handlers.delete(topic);
+    };
+  }
+}
+
+/**
+ * The topic messages for a client are published to.
+ */
+export function clientTopic(clientId: string): string {
+  return `client.${clientId}`;
+}
+
+let bus: Bus = new LocalBus();
+
+export function getBus(): Bus {
+  return bus;
+}
+
+/**
+ * Replaces the bus. Must be called before clients connect, e.g. from a
+ * plugin.
+ */
+export function setBus(replacement: Bus) {
+  bus = replacement;
+}
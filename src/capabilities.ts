@@ -0,0 +1,41 @@
+import { MAX_CHUNK_SIZE, REPLAY_WINDOW, SIGN_MESSAGES } from "./env.ts";
+import { Capabilities } from "./types.ts";
+
+/**
+ * WebSocket subprotocols naming the protocol versions this server speaks,
+ * newest first.
+ */
+export const SUBPROTOCOLS = ["wsproxy.v1"];
+
+/**
+ * Features this server implements. Optional protocol features are only
+ * used when both sides advertise them in the hello handshake.
+ */
+export const SERVER_CAPABILITIES: Capabilities = {
+  // Binary frames carry no signature, timestamp or nonce.
+  binaryFrames: !SIGN_MESSAGES && REPLAY_WINDOW <= 0,
+  compression: false,
+  requestStreaming: false,
+  tunneling: false,
+  requestAcks: true,
+  maxChunkSize: MAX_CHUNK_SIZE > 0 ? MAX_CHUNK_SIZE : undefined,
+};
+
+/**
+ * Returns the features both the client and the server support. The chunk
+ * size is the smaller of the two limits, if either side has one.
+ */
+export function negotiate(client: Capabilities): Capabilities {
+  const chunkSizes = [client.maxChunkSize, SERVER_CAPABILITIES.maxChunkSize]
+    .filter((size): size is number => typeof size === "number" && size > 0);
+  return {
+    binaryFrames: !!(client.binaryFrames && SERVER_CAPABILITIES.binaryFrames),
+    compression: !!(client.compression && SERVER_CAPABILITIES.compression),
+    requestStreaming: !!(
+      client.requestStreaming && SERVER_CAPABILITIES.requestStreaming
+    ),
+    tunneling: !!(client.tunneling && SERVER_CAPABILITIES.tunneling),
+    requestAcks: !!(client.requestAcks && SERVER_CAPABILITIES.requestAcks),
+    maxChunkSize: chunkSizes.length > 0 ? Math.min(...chunkSizes) : undefined,
+  };
+}
@@ -0,0 +1,140 @@
+import { CAPTURE_DIR, REDACT_HEADERS } from "./env.ts";
+import { ChunkFrame } from "./frames.ts";
+import { createLogger } from "./log.ts";
+import { ProxyMessageUnion, ProxyRequest } from "./types.ts";
+
+const log = createLogger("capture");
+
+export interface CaptureRules {
+  enabled: boolean;
+  paths: string[]; // Path prefixes
+  requestIds: string[]; // Matched against the caller's X-Request-Id header
+}
+
+interface Transcript {
+  uuid: string;
+  startedAt: string;
+  headers: Record<string, string>;
+  messages: {
+    elapsed: number; // Milliseconds since the request was dispatched
+    direction: "out" | "in";
+    message: ProxyMessageUnion;
+  }[];
+  outcome?: string;
+}
+
+let rules: CaptureRules = { enabled: false, paths: [], requestIds: [] };
+const transcripts = new Map<string, { start: number; data: Transcript }>();
+
+/**
+ * Copies headers into a plain object, replacing the values of sensitive
+ * headers (see REDACT_HEADERS) with a placeholder.
+ */
+export function redactHeaders(
+  headers: Headers | Record<string, string>,
+): Record<string, string> {
+  const entries = headers instanceof Headers
+    ? headers.entries()
+    : Object.entries(headers);
+  const result: Record<string, string> = {};
+  for (const [name, value] of entries) {
+    const sensitive = REDACT_HEADERS.includes(name.toLowerCase());
+    result[name] = sensitive ? "[REDACTED]" : value;
+  }
+  return result;
+}
+
+export function getCaptureRules(): CaptureRules {
+  return rules;
+}
+
+/**
+ * Updates the capture rules, throwing if a field has the wrong type.
+ */
+export function setCaptureRules(update: Partial<CaptureRules>) {
+  if (update.enabled !== undefined && typeof update.enabled !== "boolean") {
+    throw new Error("enabled must be a boolean");
+  }
+  for (const field of ["paths", "requestIds"] as const) {
+    const value = update[field];
+    if (
+      value !== undefined &&
+      (!Array.isArray(value) || value.some((item) => typeof item !== "string"))
+    ) {
+      throw new Error(`${field} must be an array of strings`);
+    }
+  }
+  rules = { ...rules, ...update };
+}
+
+/**
+ * Starts a transcript for the request if it matches the capture rules.
+ */
+export function beginCapture(request: ProxyRequest, headers: Headers) {
+  if (!rules.enabled) return;
+
+  const requestId = headers.get("x-request-id");
+  const matches =
+    rules.paths.some((prefix) => request.path.startsWith(prefix)) ||
+    (requestId !== null && rules.requestIds.includes(requestId));
+  if (!matches) return;
+
+  transcripts.set(request.uuid, {
+    start: performance.now(),
+    data: {
+      uuid: request.uuid,
+      startedAt: new Date().toISOString(),
+      headers: redactHeaders(headers),
+      messages: [],
+    },
+  });
+  captureMessage(request.uuid, "out", request);
+}
+
+export function captureMessage(
+  uuid: string,
+  direction: "out" | "in",
+  message: ProxyMessageUnion,
+) {
+  const transcript = transcripts.get(uuid);
+  if (!transcript) return;
+
+  if (message.type === "response-headers") {
+    message = { ...message, headers: redactHeaders(message.headers) };
+  }
+  const elapsed = performance.now() - transcript.start;
+  transcript.data.messages.push({ elapsed, direction, message });
+}
+
+/**
+ * Records a binary chunk frame, as the response-chunk it stands in for.
+ */
+export function captureFrame(frame: ChunkFrame) {
+  if (!transcripts.has(frame.uuid)) return;
+  captureMessage(frame.uuid, "in", {
+    type: "response-chunk",
+    uuid: frame.uuid,
+    data: btoa(String.fromCharCode(...frame.data)),
+    encoding: "base64",
+    isFinal: frame.isFinal,
+  });
+}
+
+/**
+ * Writes the transcript of a finished request to CAPTURE_DIR.
+ */
+export function endCapture(uuid: string, outcome: string) {
+  const transcript = transcripts.get(uuid);
+  if (!transcript) return;
+  transcripts.delete(uuid);
+
+  transcript.data.outcome = outcome;
+  Deno.mkdir(CAPTURE_DIR, { recursive: true })
+    .then(() =>
+      Deno.writeTextFile(
+        `${CAPTURE_DIR}/${uuid}.json`,
+        JSON.stringify(transcript.data, null, 2),
+      )
+    )
+    .catch((error) => log.error(`Failed to write capture ${uuid}:`, error));
+}
@@ -0,0 +1,40 @@
+import { CHAOS_MAX_DELAY, CHAOS_RATE } from "./env.ts";
+import { createLogger } from "./log.ts";
+
+const log = createLogger("chaos");
+
+const FAULTS = ["disconnect", "delay", "drop", "corrupt"] as const;
+
+/**
+ * Passes a message from the proxy client to `deliver`, unless chaos mode
+ * picks a fault for it: the client is disconnected, or the message is
+ * delayed, dropped or truncated. With CHAOS_RATE unset this is a no-op.
+ */
+export function applyChaos<T extends string | ArrayBuffer>(
+  socket: WebSocket,
+  data: T,
+  deliver: (data: T) => void,
+) {
+  if (CHAOS_RATE <= 0 || Math.random() >= CHAOS_RATE) {
+    deliver(data);
+    return;
+  }
+
+  const fault = FAULTS[Math.floor(Math.random() * FAULTS.length)];
+  log.warn(`Chaos: injecting ${fault} fault.`);
+  switch (fault) {
+    case "disconnect":
+      socket.close(1011, "Chaos: injected disconnect");
+      break;
+    case "delay":
+      setTimeout(() => deliver(data), Math.random() * CHAOS_MAX_DELAY);
+      break;
+    case "drop":
+      break;
+    case "corrupt": {
+      const length = typeof data === "string" ? data.length : data.byteLength;
+      deliver(data.slice(0, Math.floor(Math.random() * length)) as T);
+      break;
+    }
+  }
+}
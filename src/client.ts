@@ -0,0 +1,295 @@
+import { SUBPROTOCOLS } from "./capabilities.ts";
+import { SIGN_MESSAGES } from "./env.ts";
+import { encodeChunkFrame } from "./frames.ts";
+import { stampMessage } from "./nonces.ts";
+import { PROXY_UPGRADE_PATH } from "./paths.ts";
+import { deriveSigningKey, signWithKey, verifyWithKey } from "./signing.ts";
+import {
+  AnnouncedRoute,
+  Capabilities,
+  ClientConfig,
+  ClientHealth,
+  ProxyConfigAck,
+  ProxyGoodbye,
+  ProxyHeartbeat,
+  ProxyHello,
+  ProxyMessageUnion,
+  ProxyRequest,
+  ProxyRequestAck,
+  ProxyResponseChunk,
+  ProxyResponseHeaders,
+} from "./types.ts";
+
+interface Session {
+  key?: Promise<string>; // Set when SIGN_MESSAGES is enabled
+  outbound: Promise<void>; // Writes waiting on signatures, in order
+}
+
+const sessions = new WeakMap<WebSocket, Session>();
+
+/**
+ * Writes a message or binary frame to the server. Messages are stamped for
+ * REPLAY_WINDOW and, with SIGN_MESSAGES, signed with the key derived from
+ * the client's credential first; everything is written in the order it was
+ * sent.
+ */
+function send(socket: WebSocket, message: ProxyMessageUnion | Uint8Array) {
+  if (!(message instanceof Uint8Array)) message = stampMessage(message);
+  const session = sessions.get(socket);
+  const key = session?.key;
+  if (!session || !key) {
+    socket.send(
+      message instanceof Uint8Array ? message : JSON.stringify(message),
+    );
+    return;
+  }
+  session.outbound = session.outbound
+    .then(async () => {
+      socket.send(
+        message instanceof Uint8Array
+          ? message
+          : JSON.stringify(await signWithKey(message, await key)),
+      );
+    })
+    .catch((error) => console.error("Failed to send message:", error));
+}
+
+/**
+ * Parses a message from the server, or returns null if its signature is
+ * missing or wrong when SIGN_MESSAGES is enabled.
+ */
+async function receive(
+  socket: WebSocket,
+  data: string,
+): Promise<ProxyMessageUnion | null> {
+  const message: ProxyMessageUnion = JSON.parse(data);
+  const key = sessions.get(socket)?.key;
+  if (key && !(await verifyWithKey(message, await key))) {
+    console.warn(`Dropping message with invalid signature: ${message.uuid}`);
+    return null;
+  }
+  return message;
+}
+
+/**
+ * Connects to a server as a proxy client, calling `onRequest` for every
+ * request it dispatches and `onConfig` for pushed settings, which are acked
+ * unless it throws. Resolves once the connection is open. `password` is the
+ * password, a client token or a JWT, and keys message signatures when
+ * SIGN_MESSAGES is enabled.
+ */
+export function connectClient(
+  target: string,
+  password: string,
+  onRequest: (socket: WebSocket, request: ProxyRequest) => void,
+  onConfig?: (socket: WebSocket, config: ClientConfig) => void,
+): Promise<WebSocket> {
+  if (SIGN_MESSAGES && !password) {
+    return Promise.reject(
+      new Error("SIGN_MESSAGES requires a password, token or JWT"),
+    );
+  }
+  const url = new URL(PROXY_UPGRADE_PATH, target);
+  url.protocol = url.protocol === "https:" ? "wss:" : "ws:";
+  if (password) url.searchParams.set("password", password);
+
+  const socket = new WebSocket(url, SUBPROTOCOLS);
+  sessions.set(socket, {
+    key: SIGN_MESSAGES ? deriveSigningKey(password) : undefined,
+    outbound: Promise.resolve(),
+  });
+  const handleMessage = (message: ProxyMessageUnion) => {
+    if (message.type === "request") {
+      sendRequestAck(socket, message.uuid);
+      onRequest(socket, message);
+    }
+    if (message.type === "config" && onConfig) {
+      try {
+        onConfig(socket, message.config);
+        sendConfigAck(socket, message.uuid);
+      } catch (error) {
+        sendConfigAck(
+          socket,
+          message.uuid,
+          error instanceof Error ? error.message : String(error),
+        );
+      }
+    }
+  };
+  // Messages are handled in order, even though checking signatures is
+  // asynchronous.
+  let inbound = Promise.resolve();
+  socket.onmessage = (event) => {
+    if (typeof event.data !== "string") return;
+    const data = event.data;
+    inbound = inbound
+      .then(() => receive(socket, data))
+      .then((message) => {
+        if (message) handleMessage(message);
+      })
+      .catch((error) => console.error("Failed to handle message:", error));
+  };
+
+  return new Promise((resolve, reject) => {
+    socket.onopen = () => resolve(socket);
+    socket.onerror = () => reject(new Error(`Failed to connect to ${url}`));
+  });
+}
+
+/**
+ * Declares the optional features the client supports and, optionally, the
+ * routes it serves. The server answers with a hello-ack listing the
+ * features both sides support.
+ */
+export function sendHello(
+  socket: WebSocket,
+  capabilities: Capabilities,
+  routes?: AnnouncedRoute[],
+) {
+  const hello: ProxyHello = {
+    type: "hello",
+    uuid: crypto.randomUUID(),
+    capabilities,
+    routes,
+  };
+  send(socket, hello);
+}
+
+/**
+ * Says hello and resolves with the features the server agreed to use.
+ */
+export function negotiateCapabilities(
+  socket: WebSocket,
+  capabilities: Capabilities,
+  routes?: AnnouncedRoute[],
+): Promise<Capabilities> {
+  return new Promise((resolve) => {
+    const onMessage = async (event: MessageEvent) => {
+      if (typeof event.data !== "string") return;
+      const message = await receive(socket, event.data);
+      if (message?.type !== "hello-ack") return;
+      socket.removeEventListener("message", onMessage);
+      resolve(message.capabilities);
+    };
+    socket.addEventListener("message", onMessage);
+    sendHello(socket, capabilities, routes);
+  });
+}
+
+/**
+ * Reports the client's load to the server.
+ */
+export function sendHeartbeat(socket: WebSocket, health: ClientHealth) {
+  const heartbeat: ProxyHeartbeat = {
+    type: "heartbeat",
+    uuid: crypto.randomUUID(),
+    health,
+  };
+  send(socket, heartbeat);
+}
+
+/**
+ * Tells the server the client is shutting down. It stops dispatching new
+ * requests and closes the socket once in-flight responses are sent.
+ */
+export function sendGoodbye(socket: WebSocket, reason?: string) {
+  const goodbye: ProxyGoodbye = {
+    type: "goodbye",
+    uuid: crypto.randomUUID(),
+    reason,
+  };
+  send(socket, goodbye);
+}
+
+/**
+ * Confirms a request was received. Clients that negotiated requestAcks must
+ * send it right away.
+ */
+export function sendRequestAck(socket: WebSocket, uuid: string) {
+  const ack: ProxyRequestAck = { type: "request-ack", uuid };
+  send(socket, ack);
+}
+
+/**
+ * Answers a config message, with an error if the settings couldn't be
+ * applied.
+ */
+export function sendConfigAck(socket: WebSocket, uuid: string, error?: string) {
+  const ack: ProxyConfigAck = {
+    type: "config-ack",
+    uuid,
+    ok: error === undefined,
+    error,
+  };
+  send(socket, ack);
+}
+
+/**
+ * A complete response to send for a request, see sendResponse.
+ */
+export interface ClientResponse {
+  status: number;
+  statusText?: string;
+  headers: Record<string, string>;
+  body: string | Uint8Array;
+  destination?: string; // URL fetched, checked against ALLOWED_DESTINATIONS
+}
+
+function encodeChunk(
+  data: string | Uint8Array,
+): Pick<ProxyResponseChunk, "data" | "encoding"> {
+  if (typeof data === "string") return { data };
+  return { data: btoa(String.fromCharCode(...data)), encoding: "base64" };
+}
+
+/**
+ * Sends a complete response for a request: the headers message followed by
+ * the body, split into chunks of `chunkSize` characters, or bytes for binary
+ * bodies, which are sent base64-encoded. With `binaryFrames`, which must
+ * have been negotiated, the body is sent as binary frames instead.
+ */
+export function sendResponse(
+  socket: WebSocket,
+  uuid: string,
+  response: ClientResponse,
+  chunkSize = 16384,
+  binaryFrames = false,
+) {
+  const headers: ProxyResponseHeaders = {
+    type: "response-headers",
+    uuid,
+    status: response.status,
+    statusText: response.statusText ?? "",
+    headers: response.headers,
+    destination: response.destination,
+  };
+  send(socket, headers);
+
+  if (binaryFrames) {
+    const body = typeof response.body === "string"
+      ? new TextEncoder().encode(response.body)
+      : response.body;
+    let offset = 0;
+    do {
+      send(socket, encodeChunkFrame({
+        uuid,
+        data: body.subarray(offset, offset + chunkSize),
+        isFinal: offset + chunkSize >= body.byteLength,
+      }));
+      offset += chunkSize;
+    } while (offset < body.byteLength);
+    return;
+  }
+
+  let offset = 0;
+  do {
+    const chunk: ProxyResponseChunk = {
+      type: "response-chunk",
+      uuid,
+      ...encodeChunk(response.body.slice(offset, offset + chunkSize)),
+      isFinal: offset + chunkSize >= response.body.length,
+    };
+    send(socket, chunk);
+    offset += chunkSize;
+  } while (offset < response.body.length);
+}
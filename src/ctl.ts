@@ -0,0 +1,123 @@
+import { parseArgs } from "@std/cli/parse-args";
+import { HOSTNAME, PASSWORD, PORT } from "./env.ts";
+import { ADMIN_PATH } from "./paths.ts";
+
+const USAGE = `Usage: main.ts ctl <command> [options]
+
+Options:
+  --target URL         the server, default http://HOSTNAME:PORT
+  --admin-token TOKEN  the admin PASSWORD, default PASSWORD
+  --json               print JSON
+
+Commands:
+  clients             show the connected client and its load
+  kick                disconnect the client
+  drain               stop sending the client requests, then disconnect it
+  maintenance on|off  answer proxied requests with 503, or stop doing so
+  tail                print requests as they start and finish
+  reload              reload the routes from ROUTES_FILE`;
+
+/**
+ * A small client for the admin API. Prints JSON with --json, and a short
+ * summary otherwise.
+ */
+export async function runCtl(args: string[]) {
+  const flags = parseArgs(args, {
+    string: ["target", "admin-token"],
+    boolean: ["json"],
+    default: {
+      target: `http://${HOSTNAME}:${PORT}`,
+      "admin-token": PASSWORD ?? "",
+    },
+  });
+  const [command, argument] = flags._.map(String);
+
+  const call = async (method: string, route: string, body?: unknown) => {
+    const headers = new Headers();
+    if (flags["admin-token"]) {
+      headers.set("authorization", `Bearer ${flags["admin-token"]}`);
+    }
+    let response: Response;
+    try {
+      response = await fetch(new URL(`${ADMIN_PATH}${route}`, flags.target), {
+        method,
+        headers,
+        body: body === undefined ? undefined : JSON.stringify(body),
+      });
+    } catch (error) {
+      console.error(`Failed to reach ${flags.target}: ${error}`);
+      Deno.exit(1);
+    }
+    if (!response.ok) {
+      console.error(`${response.status} ${await response.text()}`);
+      Deno.exit(1);
+    }
+    return response;
+  };
+  const print = (result: unknown, summary: string) =>
+    console.log(flags.json ? JSON.stringify(result) : summary);
+
+  switch (command) {
+    case "clients": {
+      const stats = await (await call("GET", "/stats")).json();
+      print(
+        stats,
+        stats.clientId
+          ? `${stats.clientId} ${stats.connected ? "connected" : "draining"}` +
+            `${stats.quarantined ? " (quarantined)" : ""}, ` +
+            `${stats.pendingRequests} pending, ${stats.queuedRequests} queued`
+          : "No client connected",
+      );
+      break;
+    }
+
+    case "kick":
+    case "drain":
+      await call("POST", `/client/${command}`);
+      print({ ok: true }, command === "kick" ? "Disconnected" : "Draining");
+      break;
+
+    case "maintenance": {
+      if (argument !== "on" && argument !== "off") {
+        console.error("Usage: main.ts ctl maintenance on|off");
+        Deno.exit(1);
+      }
+      const body = { enabled: argument === "on" };
+      const state = await (await call("PUT", "/maintenance", body)).json();
+      print(state, `Maintenance mode ${argument}`);
+      break;
+    }
+
+    case "tail": {
+      const response = await call("GET", "/requests/stream");
+      let buffer = "";
+      for await (
+        const text of response.body!.pipeThrough(new TextDecoderStream())
+      ) {
+        buffer += text;
+        const events = buffer.split("\n\n");
+        buffer = events.pop()!;
+        for (const event of events) {
+          if (!event.startsWith("data: ")) continue;
+          const entry = JSON.parse(event.slice("data: ".length));
+          print(
+            entry,
+            `${entry.method} ${entry.path} ${entry.status ?? "-"} ` +
+              `${entry.outcome ?? "in flight"}`,
+          );
+        }
+      }
+      break;
+    }
+
+    case "reload": {
+      const routes = await (await call("POST", "/reload")).json();
+      print(routes, `Reloaded ${routes.length} routes`);
+      break;
+    }
+
+    default:
+      console.error(USAGE);
+      Deno.exit(1);
+  }
+}
@@ -0,0 +1,156 @@
+/**
+ * A single-page dashboard served by the admin API. It polls the stats and
+ * usage endpoints, passing on the page's own query string so the password
+ * given in the URL authenticates those requests too.
+ */
+export const dashboardHtml = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>ws_proxy</title>
+<style>
+  body { font: 14px system-ui, sans-serif; margin: 2em; color: #222; }
+  h1 { font-size: 1.4em; }
+  .tiles { display: flex; gap: 1em; flex-wrap: wrap; }
+  .tile { border: 1px solid #ddd; border-radius: 6px; padding: 0.8em 1.2em; }
+  .tile b { display: block; font-size: 1.6em; }
+  svg { border: 1px solid #ddd; border-radius: 6px; margin-top: 1em; }
+  table { border-collapse: collapse; margin-top: 1em; }
+  th, td {
+    border-bottom: 1px solid #eee; padding: 0.3em 0.8em; text-align: right;
+  }
+  th:first-child, td:first-child { text-align: left; }
+  .down { color: #b00; }
+</style>
+</head>
+<body>
+<h1>ws_proxy</h1>
+<div class="tiles">
+  <div class="tile">Client<b id="client">-</b></div>
+  <div class="tile">Requests/s<b id="rate">-</b></div>
+  <div class="tile">Errors/s<b id="errors">-</b></div>
+  <div class="tile">Avg latency<b id="latency">-</b></div>
+  <div class="tile">Pending<b id="pending">-</b></div>
+  <div class="tile">Queued<b id="queued">-</b></div>
+</div>
+<svg id="chart" width="600" height="120" viewBox="0 0 600 120"></svg>
+<table>
+  <thead><tr><th>Client</th><th>Connected</th><th>Requests</th><th>Errors</th>
+  <th>Bytes in</th><th>Bytes out</th><th>Avg latency</th></tr></thead>
+  <tbody id="clients"></tbody>
+</table>
+<h2>Requests</h2>
+<table>
+  <thead><tr><th>Path</th><th>Method</th><th>Client</th><th>Status</th>
+  <th>Duration</th><th>Outcome</th></tr></thead>
+  <tbody id="requests"></tbody>
+</table>
+<script>
+  const INTERVAL = 2000;
+  const history = [];
+  let previous;
+
+  const get = (path) =>
+    fetch(path + location.search).then((res) => res.json());
+  const ms = (value) => value.toFixed(1) + " ms";
+
+  function line(values, max, color) {
+    const points = values.map((value, i) =>
+      (i * 10) + "," + (115 - (value / max) * 110)
+    );
+    return '<polyline fill="none" stroke="' + color + '" points="' +
+      points.join(" ") + '"/>';
+  }
+
+  async function refresh() {
+    const [stats, usage] = await Promise.all([get("stats"), get("usage")]);
+    const totals = usage.reduce((sum, client) => ({
+      requests: sum.requests + client.requests,
+      errors: sum.errors + client.errors,
+    }), { requests: 0, errors: 0 });
+
+    const sample = { ...totals, rate: 0, errorRate: 0 };
+    if (previous) {
+      sample.rate = Math.max(0, totals.requests - previous.requests) /
+        (INTERVAL / 1000);
+      sample.errorRate = Math.max(0, totals.errors - previous.errors) /
+        (INTERVAL / 1000);
+    }
+    previous = totals;
+    const current = usage.find((client) => client.clientId === stats.clientId);
+    sample.latency = current ? current.averageLatency : 0;
+    history.push(sample);
+    if (history.length > 60) history.shift();
+
+    const client = document.getElementById("client");
+    client.textContent = stats.connected ? stats.clientId.slice(0, 8) : "none";
+    client.className = stats.connected ? "" : "down";
+    document.getElementById("rate").textContent = sample.rate.toFixed(1);
+    document.getElementById("errors").textContent =
+      sample.errorRate.toFixed(1);
+    document.getElementById("latency").textContent = ms(sample.latency);
+    document.getElementById("pending").textContent = stats.pendingRequests;
+    document.getElementById("queued").textContent = stats.queuedRequests;
+
+    const maxRate = Math.max(1, ...history.map((s) => s.rate));
+    const maxLatency = Math.max(1, ...history.map((s) => s.latency));
+    document.getElementById("chart").innerHTML =
+      line(history.map((s) => s.rate), maxRate, "#36c") +
+      line(history.map((s) => s.errorRate), maxRate, "#c33") +
+      line(history.map((s) => s.latency), maxLatency, "#999");
+
+    const rows = document.getElementById("clients");
+    rows.replaceChildren(...usage.reverse().map((entry) => {
+      const row = document.createElement("tr");
+      for (const value of [
+        entry.identity +
+        (entry.clientId === stats.clientId ? " (current)" : ""),
+        new Date(entry.connectedAt).toLocaleString(),
+        entry.requests,
+        entry.errors,
+        entry.bytesIn,
+        entry.bytesOut,
+        ms(entry.averageLatency),
+      ]) {
+        const cell = document.createElement("td");
+        cell.textContent = value;
+        row.append(cell);
+      }
+      return row;
+    }));
+  }
+
+  // The live tail: the latest update of the last 30 requests, newest first.
+  const requests = new Map();
+  new EventSource("requests/stream" + location.search).onmessage = (event) => {
+    const entry = JSON.parse(event.data);
+    requests.delete(entry.uuid);
+    requests.set(entry.uuid, entry);
+    if (requests.size > 30) requests.delete(requests.keys().next().value);
+
+    document.getElementById("requests").replaceChildren(
+      ...[...requests.values()].reverse().map((entry) => {
+        const row = document.createElement("tr");
+        for (const value of [
+          entry.path,
+          entry.method,
+          entry.clientId.slice(0, 8),
+          entry.status ?? "",
+          entry.duration === undefined ? "in flight" : ms(entry.duration),
+          entry.outcome ?? "",
+        ]) {
+          const cell = document.createElement("td");
+          cell.textContent = value;
+          row.append(cell);
+        }
+        return row;
+      }),
+    );
+  };
+
+  refresh();
+  setInterval(() => refresh().catch(console.error), INTERVAL);
+</script>
+</body>
+</html>
+`;
@@ -0,0 +1,95 @@
+import { redactHeaders } from "./capture.ts";
+import { DEBUG_LOG_BODY_SIZE, DEBUG_LOG_PATHS } from "./env.ts";
+import { createLogger } from "./log.ts";
+
+const log = createLogger("debug-log");
+
+export interface DebugLogRules {
+  enabled: boolean;
+  paths: string[]; // Path prefixes
+  maxBodySize: number; // Characters of each body to log
+}
+
+let rules: DebugLogRules = {
+  enabled: DEBUG_LOG_PATHS.length > 0,
+  paths: DEBUG_LOG_PATHS,
+  maxBodySize: DEBUG_LOG_BODY_SIZE,
+};
+
+export function getDebugLogRules(): DebugLogRules {
+  return rules;
+}
+
+/**
+ * Updates the debug log rules, throwing if a field has the wrong type.
+ */
+export function setDebugLogRules(update: Partial<DebugLogRules>) {
+  if (update.enabled !== undefined && typeof update.enabled !== "boolean") {
+    throw new Error("enabled must be a boolean");
+  }
+  if (
+    update.paths !== undefined &&
+    (!Array.isArray(update.paths) ||
+      update.paths.some((path) => typeof path !== "string"))
+  ) {
+    throw new Error("paths must be an array of strings");
+  }
+  if (
+    update.maxBodySize !== undefined &&
+    (!Number.isInteger(update.maxBodySize) || update.maxBodySize < 0)
+  ) {
+    throw new Error("maxBodySize must be a non-negative integer");
+  }
+  rules = { ...rules, ...update };
+}
+
+export function matchesDebugLog(path: string): boolean {
+  return rules.enabled && rules.paths.some((prefix) => path.startsWith(prefix));
+}
+
+function truncate(text: string): string {
+  if (text.length <= rules.maxBodySize) return text;
+  return `${text.slice(0, rules.maxBodySize)}... (${text.length} chars)`;
+}
+
+async function readTruncated(stream: ReadableStream<Uint8Array>) {
+  const decoder = new TextDecoder();
+  const reader = stream.getReader();
+  let text = "";
+  try {
+    while (text.length <= rules.maxBodySize) {
+      const { done, value } = await reader.read();
+      if (done) return text;
+      text += decoder.decode(value, { stream: true });
+    }
+    await reader.cancel();
+    return `${text.slice(0, rules.maxBodySize)}... (truncated)`;
+  } catch (error) {
+    return `${text}... (${error})`;
+  }
+}
+
+export function logDebugRequest(req: Request, path: string, body?: string) {
+  log.info(`Request ${req.method} ${path}`, {
+    headers: redactHeaders(req.headers),
+    body: body === undefined ? undefined : truncate(body),
+  });
+}
+
+/**
+ * Logs the response headers right away and its body once enough of it has
+ * streamed through. Returns the response to send on to the caller.
+ */
+export function logDebugResponse(path: string, response: Response): Response {
+  const headers = redactHeaders(response.headers);
+  if (!response.body) {
+    log.info(`Response ${response.status} for ${path}`, { headers });
+    return response;
+  }
+
+  const [body, copy] = response.body.tee();
+  readTruncated(copy).then((text) =>
+    log.info(`Response ${response.status} for ${path}`, { headers, body: text })
+  );
+  return new Response(body, response);
+}
@@ -0,0 +1,21 @@
+import { ALLOWED_DESTINATIONS } from "./env.ts";
+
+/**
+ * Checks a destination URL reported by a client against
+ * ALLOWED_DESTINATIONS. "*.example.com" matches any subdomain of
+ * example.com; other entries must match the host exactly.
+ */
+export function isAllowedDestination(destination: string): boolean {
+  let hostname: string;
+  try {
+    hostname = new URL(destination).hostname;
+  } catch {
+    return false;
+  }
+
+  return ALLOWED_DESTINATIONS.some((pattern) =>
+    pattern.startsWith("*.")
+      ? hostname.endsWith(pattern.slice(1))
+      : hostname === pattern
+  );
+}
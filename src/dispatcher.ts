@@ -0,0 +1,136 @@
+import { ConfigPush, ProxyManager, RequestOptions } from "./proxy.ts";
+import {
+  AnnouncedRoute,
+  Capabilities,
+  ClientConfig,
+  ClientHealth,
+} from "./types.ts";
+
+/**
+ * A connected proxy client, as seen by the server.
+ */
+export interface ClientConn {
+  readonly id: string;
+  readonly capabilities: Capabilities;
+  readonly health: (ClientHealth & { receivedAt: string }) | null;
+}
+
+/**
+ * A response streaming in from a proxy client: its status line and headers
+ * once they arrived, and the body as the client sends it. Response is the
+ * default implementation.
+ */
+export interface ResponseStream {
+  readonly status: number;
+  readonly statusText: string;
+  readonly headers: Headers;
+  readonly body: ReadableStream<Uint8Array> | null;
+}
+
+/**
+ * Returns the response stream as a Response the HTTP handler can serve.
+ */
+export function toResponse(stream: ResponseStream): Response {
+  if (stream instanceof Response) return stream;
+  const { status, statusText, headers } = stream;
+  return new Response(stream.body, { status, statusText, headers });
+}
+
+/**
+ * A snapshot of a dispatcher's state, for the admin API and metrics.
+ */
+export interface DispatcherStats {
+  connected: boolean; // Whether new requests can be dispatched
+  clientId: string | null; // Also while the client drains or is quarantined
+  quarantined: boolean;
+  capabilities: Capabilities;
+  routes: Record<string, AnnouncedRoute[]>; // Announced, by client ID
+  health: (ClientHealth & { receivedAt: string }) | null;
+  pendingRequests: number;
+  queuedRequests: number;
+  shedRequests: number;
+  bufferedBytes: number; // Response bytes not yet taken by callers
+}
+
+/**
+ * What the HTTP handler, the admin API and shutdown need from whatever
+ * dispatches requests to proxy clients. ProxyManager is the default;
+ * embedders can swap in their own, e.g. a mock in tests.
+ */
+export interface Dispatcher {
+  /** The client new requests go to, or null if none is connected. */
+  readonly client: ClientConn | null;
+  readonly pendingCount: number;
+  readonly queuedCount: number;
+
+  /**
+   * Upgrades a proxy client's WebSocket request and takes it on. `identity`
+   * says who the client authenticated as, e.g. "token:<id>", and `secret`
+   * is the credential it did so with, which message signing keys derive
+   * from. A client whose credential expires, like a JWT, is disconnected at
+   * `expiresAt`, in milliseconds since the epoch.
+   */
+  accept(
+    req: Request,
+    identity?: string,
+    secret?: string,
+    expiresAt?: number,
+  ): Response;
+
+  /** Whether the current client serves requests for the host and path. */
+  serves(host: string, pathname: string): boolean;
+
+  /**
+   * Dispatches a request and resolves with its response, whose body is
+   * streamed as the client sends it.
+   */
+  request(
+    method: string,
+    path: string,
+    body?: string,
+    requestHeaders?: Headers,
+    options?: RequestOptions,
+  ): Promise<ResponseStream>;
+
+  stats(): DispatcherStats;
+
+  /** The last configuration pushed to each connected client. */
+  readonly configStatus: Record<string, ConfigPush>;
+
+  /**
+   * Pushes settings to the current client. Resolves with the push, or null
+   * if no client is connected.
+   */
+  pushConfig(config: ClientConfig): Promise<ConfigPush | null>;
+
+  /**
+   * Tells the current client to close its pooled upstream connections, to
+   * `host` or all hosts. Resolves with false if no client is connected.
+   */
+  flushPools(host?: string): Promise<boolean>;
+
+  /**
+   * Stops sending the current client new requests and closes it once its
+   * pending ones are done. Returns false if no client is connected.
+   */
+  drain(): boolean;
+
+  /** Disconnects the current client. Returns false if there is none. */
+  kick(): boolean;
+
+  /** Disconnects the client if it authenticated with the given token. */
+  disconnectToken(tokenId: string): void;
+}
+
+let dispatcher: Dispatcher = ProxyManager;
+
+export function getDispatcher(): Dispatcher {
+  return dispatcher;
+}
+
+/**
+ * Replaces the dispatcher the HTTP handler uses.
+ */
+export function setDispatcher(replacement: Dispatcher) {
+  dispatcher = replacement;
+}
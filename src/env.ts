@@ -1,5 +1,284 @@
 import "@std/dotenv/load";
+import { OVERFLOW_POLICIES, OverflowPolicy } from "./queue.ts";
+
+/**
+ * Reads a comma-separated list, skipping empty entries.
+ */
+function list(name: string, fallback = ""): string[] {
+  return (Deno.env.get(name) ?? fallback)
+    .split(",").map((entry) => entry.trim()).filter(Boolean);
+}
 
 export const HOSTNAME = Deno.env.get("HOSTNAME") ?? "localhost";
 export const PORT = Deno.env.get("PORT") ?? "7769";
 export const PASSWORD = Deno.env.get("PASSWORD");
+
+// Let several processes listen on the port, so a new one can take over
+// while the old one shuts down (Linux only), and seconds a shutdown may wait
+// for in-flight requests, 0 for no limit.
+export const REUSE_PORT = Deno.env.get("REUSE_PORT") === "true";
+export const SHUTDOWN_TIMEOUT = Number.parseInt(
+  Deno.env.get("SHUTDOWN_TIMEOUT") ?? "30",
+);
+
+// File the server's process ID is written to, for service managers.
+export const PID_FILE = Deno.env.get("PID_FILE");
+
+// Fault injection for testing clients and retry policies, off by default.
+export const CHAOS_RATE = Number.parseFloat(Deno.env.get("CHAOS_RATE") ?? "0");
+export const CHAOS_MAX_DELAY = Number.parseInt(
+  Deno.env.get("CHAOS_MAX_DELAY") ?? "5000",
+);
+
+// Appends every proxied request to this file as JSON lines when set.
+export const RECORD_FILE = Deno.env.get("RECORD_FILE");
+
+// Debug capture transcripts, enabled at runtime through the admin API.
+export const CAPTURE_DIR = Deno.env.get("CAPTURE_DIR") ?? "captures";
+export const REDACT_HEADERS = list(
+  "REDACT_HEADERS",
+  "authorization,cookie,set-cookie,proxy-authorization",
+).map((name) => name.toLowerCase());
+
+// Client identities with their own series in the metrics; the rest share
+// "other".
+export const METRICS_MAX_CLIENTS = Number.parseInt(
+  Deno.env.get("METRICS_MAX_CLIENTS") ?? "50",
+);
+
+// Periodic dump of the per-client usage report.
+export const USAGE_DUMP_FILE = Deno.env.get("USAGE_DUMP_FILE");
+export const USAGE_DUMP_INTERVAL = Number.parseInt(
+  Deno.env.get("USAGE_DUMP_INTERVAL") ?? "300",
+);
+
+// Webhooks notified when a proxy client connects or disconnects.
+export const WEBHOOK_URLS = list("WEBHOOK_URLS");
+export const WEBHOOK_SECRET = Deno.env.get("WEBHOOK_SECRET");
+
+// Append-only log of admin API actions.
+export const AUDIT_LOG_FILE = Deno.env.get("AUDIT_LOG_FILE");
+
+// Journal of accepted requests, to report those a crash left unanswered.
+export const JOURNAL_FILE = Deno.env.get("JOURNAL_FILE");
+
+// Log file output with size-based rotation.
+export const LOG_FILE = Deno.env.get("LOG_FILE");
+export const LOG_MAX_SIZE = Number.parseInt(
+  Deno.env.get("LOG_MAX_SIZE") ?? String(10 * 1024 * 1024),
+);
+export const LOG_MAX_FILES = Number.parseInt(
+  Deno.env.get("LOG_MAX_FILES") ?? "5",
+);
+
+// Where logs go besides LOG_FILE: "console", "journald" or "syslog-tcp".
+export const LOG_TARGET = Deno.env.get("LOG_TARGET") ?? "console";
+export const SYSLOG_ADDRESS = Deno.env.get("SYSLOG_ADDRESS") ??
+  "localhost:514";
+
+// Minimum log level, and per-component overrides like "proxy=debug".
+export const LOG_LEVEL = Deno.env.get("LOG_LEVEL") ?? "info";
+export const LOG_LEVELS = Deno.env.get("LOG_LEVELS") ?? "";
+
+// Verbose logging of headers and bodies for these path prefixes.
+export const DEBUG_LOG_PATHS = list("DEBUG_LOG_PATHS");
+export const DEBUG_LOG_BODY_SIZE = Number.parseInt(
+  Deno.env.get("DEBUG_LOG_BODY_SIZE") ?? "4096",
+);
+
+// CIDR allow and deny lists for the proxied endpoint and for /__ws_proxy.
+export const PROXY_ALLOW_IPS = list("PROXY_ALLOW_IPS");
+export const PROXY_DENY_IPS = list("PROXY_DENY_IPS");
+export const WS_ALLOW_IPS = list("WS_ALLOW_IPS");
+export const WS_DENY_IPS = list("WS_DENY_IPS");
+
+// JSON file with per-route settings, see routes.ts.
+export const ROUTES_FILE = Deno.env.get("ROUTES_FILE");
+
+// Methods that are proxied, "*" for any. TRACE, TRACK, CONNECT and
+// nonstandard verbs are refused by default.
+export const ALLOWED_METHODS = list(
+  "ALLOWED_METHODS",
+  "GET,HEAD,POST,PUT,PATCH,DELETE,OPTIONS",
+).map((method) => method.toUpperCase());
+
+// Path prefixes that are never proxied and answered with 404 locally.
+export const DENY_PATHS = list("DENY_PATHS");
+
+// Browser origins proxy clients may connect from, e.g.
+// "https://*.example.com". Clients without an Origin header are not checked.
+export const ALLOWED_ORIGINS = list("ALLOWED_ORIGINS");
+
+// Upstream hosts clients may fetch from, e.g. "api.example.com,*.example.org".
+export const ALLOWED_DESTINATIONS = list("ALLOWED_DESTINATIONS");
+
+// Sign and verify every protocol message with a key derived from PASSWORD.
+export const SIGN_MESSAGES = Deno.env.get("SIGN_MESSAGES") === "true";
+
+// Seconds a message timestamp may differ from now; 0 disables the check.
+export const REPLAY_WINDOW = Number.parseInt(
+  Deno.env.get("REPLAY_WINDOW") ?? "0",
+);
+
+// Persists client tokens minted through the admin API when set.
+export const TOKENS_FILE = Deno.env.get("TOKENS_FILE");
+
+// Accept JWTs from this OpenID Connect issuer as proxy client credentials.
+export const OIDC_ISSUER = Deno.env.get("OIDC_ISSUER");
+export const OIDC_AUDIENCE = Deno.env.get("OIDC_AUDIENCE");
+export const OIDC_JWKS_URL = Deno.env.get("OIDC_JWKS_URL");
+
+// Credentials required from callers of the proxied endpoint, if set.
+export const PROXY_BASIC_AUTH = Deno.env.get("PROXY_BASIC_AUTH"); // user:pass
+export const PROXY_BEARER_TOKEN = Deno.env.get("PROXY_BEARER_TOKEN");
+
+// Reverse proxies whose X-Forwarded-For and X-Real-IP headers are honored.
+export const TRUSTED_PROXIES = list("TRUSTED_PROXIES");
+
+// Default seconds to wait for response headers, and for the whole response
+// (0 for no limit). Routes can override both.
+export const HEADER_TIMEOUT = Number.parseInt(
+  Deno.env.get("HEADER_TIMEOUT") ?? "900",
+);
+export const TOTAL_TIMEOUT = Number.parseInt(
+  Deno.env.get("TOTAL_TIMEOUT") ?? "0",
+);
+
+// Seconds a client that negotiated requestAcks has to ack a request; 0
+// disables the check.
+export const ACK_TIMEOUT = Number.parseFloat(
+  Deno.env.get("ACK_TIMEOUT") ?? "5",
+);
+
+// Maximum request body size in bytes, 0 for no limit. Routes can override.
+export const MAX_BODY_SIZE = Number.parseInt(
+  Deno.env.get("MAX_BODY_SIZE") ?? "0",
+);
+
+// Add X-Content-Type-Options: nosniff to every proxied response.
+export const NOSNIFF = Deno.env.get("NOSNIFF") === "true";
+
+// Seconds after which finished requests are logged in detail; 0 disables.
+export const SLOW_REQUEST_THRESHOLD = Number.parseFloat(
+  Deno.env.get("SLOW_REQUEST_THRESHOLD") ?? "0",
+);
+
+// Add a Server-Timing header with the phases of each proxied request.
+export const SERVER_TIMING = Deno.env.get("SERVER_TIMING") === "true";
+
+// Maximum response body size in bytes, 0 for no limit. Routes can override.
+export const MAX_RESPONSE_SIZE = Number.parseInt(
+  Deno.env.get("MAX_RESPONSE_SIZE") ?? "0",
+);
+
+// Requests dispatched to the client at once, 0 for no limit, and how many
+// more may wait for a slot.
+export const MAX_IN_FLIGHT = Number.parseInt(
+  Deno.env.get("MAX_IN_FLIGHT") ?? "0",
+);
+export const QUEUE_SIZE = Number.parseInt(Deno.env.get("QUEUE_SIZE") ?? "100");
+
+// The range X-Wsproxy-Priority headers are clamped to, from minus to plus
+// this value. 0 ignores the header, as any caller can set it.
+export const MAX_HEADER_PRIORITY = Number.parseInt(
+  Deno.env.get("MAX_HEADER_PRIORITY") ?? "0",
+);
+
+// Requests pending or queued across the server, 0 for no limit. Beyond it
+// requests are shed with a 503 asking callers to retry after RETRY_AFTER
+// seconds.
+export const MAX_CONCURRENT_REQUESTS = Number.parseInt(
+  Deno.env.get("MAX_CONCURRENT_REQUESTS") ?? "0",
+);
+export const RETRY_AFTER = Number.parseInt(
+  Deno.env.get("RETRY_AFTER") ?? "1",
+);
+
+// Bytes of response bodies buffered for slow callers across the server, 0 for
+// no limit. New requests are shed while it is exceeded.
+export const MEMORY_BUDGET = Number.parseInt(
+  Deno.env.get("MEMORY_BUDGET") ?? "0",
+);
+
+// What to do when the queue is full, see queue.ts, and how many seconds
+// requests may wait past the limit with the "block" policy.
+export const QUEUE_OVERFLOW = (Deno.env.get("QUEUE_OVERFLOW") ??
+  "shed-lowest") as OverflowPolicy;
+if (!OVERFLOW_POLICIES.includes(QUEUE_OVERFLOW)) {
+  throw new Error(
+    `Unknown QUEUE_OVERFLOW "${QUEUE_OVERFLOW}", expected one of: ` +
+      OVERFLOW_POLICIES.join(", "),
+  );
+}
+export const QUEUE_DEADLINE = Number.parseInt(
+  Deno.env.get("QUEUE_DEADLINE") ?? "30",
+);
+
+// Connection reuse hints sent to clients with every request: whether to keep
+// upstream connections alive, and for how many seconds while idle.
+export const UPSTREAM_KEEP_ALIVE = Deno.env.get("UPSTREAM_KEEP_ALIVE") !==
+  "false";
+export const UPSTREAM_IDLE_TIMEOUT = Number.parseInt(
+  Deno.env.get("UPSTREAM_IDLE_TIMEOUT") ?? "90",
+);
+
+// Clients sending more than PROTOCOL_ERROR_LIMIT malformed messages within
+// PROTOCOL_ERROR_WINDOW seconds are quarantined, getting no new requests, or
+// disconnected (PROTOCOL_ERROR_ACTION). 0 disables the limit.
+export const PROTOCOL_ERROR_LIMIT = Number.parseInt(
+  Deno.env.get("PROTOCOL_ERROR_LIMIT") ?? "0",
+);
+export const PROTOCOL_ERROR_WINDOW = Number.parseInt(
+  Deno.env.get("PROTOCOL_ERROR_WINDOW") ?? "60",
+);
+export const PROTOCOL_ERROR_ACTION = Deno.env.get("PROTOCOL_ERROR_ACTION") ??
+  "quarantine";
+
+// Largest message clients may send, in characters (bytes for binary frames),
+// and the most response headers and characters per header they may send.
+// 0 disables a limit.
+export const MAX_MESSAGE_SIZE = Number.parseInt(
+  Deno.env.get("MAX_MESSAGE_SIZE") ?? "1048576",
+);
+export const MAX_RESPONSE_HEADERS = Number.parseInt(
+  Deno.env.get("MAX_RESPONSE_HEADERS") ?? "100",
+);
+export const MAX_HEADER_SIZE = Number.parseInt(
+  Deno.env.get("MAX_HEADER_SIZE") ?? "8192",
+);
+
+// Largest response chunk clients may send, in characters, advertised in the
+// hello handshake; 0 for no limit.
+export const MAX_CHUNK_SIZE = Number.parseInt(
+  Deno.env.get("MAX_CHUNK_SIZE") ?? "65536",
+);
+
+// Reject clients that don't offer a supported subprotocol, like "wsproxy.v1".
+export const REQUIRE_SUBPROTOCOL = Deno.env.get("REQUIRE_SUBPROTOCOL") ===
+  "true";
+
+// Seconds a client has to answer a WebSocket ping, sent every half of that,
+// before it is disconnected; 0 disables keepalive pings.
+export const WS_IDLE_TIMEOUT = Number.parseInt(
+  Deno.env.get("WS_IDLE_TIMEOUT") ?? "120",
+);
+
+// Seconds without a message from the client, or with unsent data queued for
+// it, before it is disconnected; 0 disables either deadline.
+export const WS_READ_TIMEOUT = Number.parseInt(
+  Deno.env.get("WS_READ_TIMEOUT") ?? "0",
+);
+export const WS_WRITE_TIMEOUT = Number.parseInt(
+  Deno.env.get("WS_WRITE_TIMEOUT") ?? "0",
+);
+
+// Modules imported at startup to extend the server, see plugins.ts.
+export const PLUGINS = list("PLUGINS");
+
+// Directory routes' WASM filters are loaded from, and seconds a filter may
+// take per chunk before its response is aborted. Without a directory, WASM
+// filters are disabled.
+export const WASM_FILTER_DIR = Deno.env.get("WASM_FILTER_DIR");
+export const WASM_FILTER_TIMEOUT = Number.parseFloat(
+  Deno.env.get("WASM_FILTER_TIMEOUT") ?? "1",
+);
@@ -0,0 +1,29 @@
+import { createLogger } from "./log.ts";
+
+const log = createLogger("errors");
+
+/**
+ * Receives protocol errors, request failures and unhandled handler errors,
+ * so embedders can forward them to Sentry, Rollbar and the like.
+ */
+export interface ErrorReporter {
+  report(error: unknown, context: Record<string, unknown>): void;
+}
+
+let reporter: ErrorReporter = { report() {} };
+
+export function setErrorReporter(errorReporter: ErrorReporter) {
+  reporter = errorReporter;
+}
+
+/**
+ * Passes an error to the configured reporter. A failing reporter is logged
+ * but never propagates.
+ */
+export function notifyError(error: unknown, context: Record<string, unknown>) {
+  try {
+    reporter.report(error, context);
+  } catch (reporterError) {
+    log.error("Error reporter failed:", reporterError);
+  }
+}
@@ -0,0 +1,36 @@
+// Binary response chunk frames, used when both sides support binaryFrames:
+// the request UUID as 36 ASCII characters, a flags byte, then the chunk's
+// bytes. They skip JSON and base64 entirely, but can't be signed.
+const UUID_LENGTH = 36;
+const FINAL = 0x01;
+
+const encoder = new TextEncoder();
+const decoder = new TextDecoder();
+
+export interface ChunkFrame {
+  uuid: string;
+  data: Uint8Array;
+  isFinal: boolean;
+}
+
+export function encodeChunkFrame(frame: ChunkFrame): Uint8Array {
+  const bytes = new Uint8Array(UUID_LENGTH + 1 + frame.data.byteLength);
+  encoder.encodeInto(frame.uuid, bytes);
+  bytes[UUID_LENGTH] = frame.isFinal ? FINAL : 0;
+  bytes.set(frame.data, UUID_LENGTH + 1);
+  return bytes;
+}
+
+/**
+ * Splits a binary frame into its parts, or returns null if it is too short
+ * to be one.
+ */
+export function decodeChunkFrame(buffer: ArrayBuffer): ChunkFrame | null {
+  if (buffer.byteLength < UUID_LENGTH + 1) return null;
+  const bytes = new Uint8Array(buffer);
+  return {
+    uuid: decoder.decode(bytes.subarray(0, UUID_LENGTH)),
+    isFinal: (bytes[UUID_LENGTH] & FINAL) !== 0,
+    data: bytes.subarray(UUID_LENGTH + 1),
+  };
+}
@@ -1,24 +1,349 @@
-import { PASSWORD } from "./env.ts";
-import { ProxyManager } from "./proxy.ts";
+import { adminHandler } from "./admin.ts";
+import { audit } from "./audit.ts";
+import {
+  logDebugRequest,
+  logDebugResponse,
+  matchesDebugLog,
+} from "./debuglog.ts";
+import {
+  ALLOWED_METHODS,
+  DENY_PATHS,
+  MAX_BODY_SIZE,
+  MAX_CONCURRENT_REQUESTS,
+  MAX_HEADER_PRIORITY,
+  PASSWORD,
+  PROXY_ALLOW_IPS,
+  PROXY_BASIC_AUTH,
+  PROXY_BEARER_TOKEN,
+  PROXY_DENY_IPS,
+  RETRY_AFTER,
+  TRUSTED_PROXIES,
+  WS_ALLOW_IPS,
+  WS_DENY_IPS,
+} from "./env.ts";
+import { getDispatcher, toResponse } from "./dispatcher.ts";
+import { notifyError } from "./errors.ts";
+import { timingSafeEqual } from "./hmac.ts";
+import { IpFilter, matchesAny, parseCidr } from "./ip.ts";
+import { jwtExpiry, verifyJwt } from "./jwt.ts";
+import { createLogger } from "./log.ts";
+import { inMaintenance } from "./maintenance.ts";
+import { isAllowedOrigin } from "./origin.ts";
+import { ADMIN_PATH, PROXY_UPGRADE_PATH, SCHEMA_PATH } from "./paths.ts";
+import { authenticate, runMiddleware } from "./plugins.ts";
+import { recordRequest } from "./record.ts";
+import { rewriteUrls } from "./rewrite.ts";
+import { matchRoute } from "./routes.ts";
+import { protocolSchema } from "./schema.ts";
+import { findToken } from "./tokens.ts";
+import { applyTransformers, registerTransformer } from "./transformers.ts";
+import { wasmTransformer } from "./wasm.ts";
 
-const PROXY_UPGRADE_PATH = "/__ws_proxy";
+const log = createLogger("handler");
+
+const proxyIpFilter = new IpFilter(PROXY_ALLOW_IPS, PROXY_DENY_IPS);
+const wsIpFilter = new IpFilter(WS_ALLOW_IPS, WS_DENY_IPS);
+const trustedProxies = TRUSTED_PROXIES.map(parseCidr);
+
+registerTransformer(wasmTransformer);
+
+/**
+ * Returns the credential given either as the `password` query parameter or
+ * as a bearer token.
+ */
+function credential(req: Request, url: URL): string | null {
+  const authorization = req.headers.get("authorization");
+  return url.searchParams.get("password") ??
+    (authorization?.startsWith("Bearer ") ? authorization.slice(7) : null);
+}
+
+/**
+ * Checks the password. Everything is allowed when no password is set.
+ */
+function isAuthorized(req: Request, url: URL): boolean {
+  return !PASSWORD || credential(req, url) === PASSWORD;
+}
+
+/**
+ * Checks the password for the admin API, which stays closed when no
+ * password is set.
+ */
+function isAdminAuthorized(req: Request, url: URL): boolean {
+  return !!PASSWORD && credential(req, url) === PASSWORD;
+}
+
+/**
+ * Returns the caller's IP address. This is the peer address unless the peer
+ * is a trusted proxy, in which case X-Forwarded-For is walked back to the
+ * first untrusted hop, falling back to X-Real-IP. Non-TCP peers are
+ * reported as "local".
+ */
+function clientIp(req: Request, info: Deno.ServeHandlerInfo): string {
+  const peer = "hostname" in info.remoteAddr
+    ? info.remoteAddr.hostname
+    : "local";
+  if (!matchesAny(trustedProxies, peer)) return peer;
+
+  const forwarded = (req.headers.get("x-forwarded-for") ?? "")
+    .split(",").map((hop) => hop.trim()).filter(Boolean);
+  if (forwarded.length === 0) {
+    return req.headers.get("x-real-ip")?.trim() || peer;
+  }
+  for (let i = forwarded.length - 1; i > 0; i--) {
+    if (!matchesAny(trustedProxies, forwarded[i])) return forwarded[i];
+  }
+  return forwarded[0];
+}
+
+/**
+ * Checks the caller's credentials for the proxied endpoint against
+ * PROXY_BASIC_AUTH and PROXY_BEARER_TOKEN. Anyone is allowed when neither
+ * is set.
+ */
+function isProxyAuthorized(req: Request): boolean {
+  if (!PROXY_BASIC_AUTH && !PROXY_BEARER_TOKEN) return true;
+
+  const authorization = req.headers.get("authorization") ?? "";
+  const [scheme, value = ""] = authorization.split(" ", 2);
+  switch (scheme.toLowerCase()) {
+    case "basic":
+      return !!PROXY_BASIC_AUTH &&
+        timingSafeEqual(value, btoa(PROXY_BASIC_AUTH));
+    case "bearer":
+      return !!PROXY_BEARER_TOKEN && timingSafeEqual(value, PROXY_BEARER_TOKEN);
+  }
+  return false;
+}
+
+/**
+ * Decodes the path for matching, so that encoded variants like "/%2Egit/"
+ * or "/%61pi/" are treated like the paths they stand for.
+ */
+function decodePath(pathname: string): string {
+  try {
+    return decodeURIComponent(pathname);
+  } catch {
+    // Keep malformed paths as they are.
+    return pathname;
+  }
+}
+
+/**
+ * Checks a decoded path against DENY_PATHS.
+ */
+function isDeniedPath(decoded: string): boolean {
+  return DENY_PATHS.some((prefix) => decoded.startsWith(prefix));
+}
+
+/**
+ * Returns the priority a caller asked for with X-Wsproxy-Priority, clamped
+ * to plus or minus MAX_HEADER_PRIORITY, so callers can't jump the whole
+ * queue.
+ */
+function headerPriority(req: Request): number {
+  const priority =
+    Number.parseInt(req.headers.get("x-wsproxy-priority") ?? "") || 0;
+  return Math.max(
+    -MAX_HEADER_PRIORITY,
+    Math.min(priority, MAX_HEADER_PRIORITY),
+  );
+}
+
+/**
+ * Reads the request body as text, or returns null as soon as it turns out
+ * to be larger than `limit` bytes (0 for no limit).
+ */
+async function readBody(req: Request, limit: number): Promise<string | null> {
+  if (!req.body) return "";
+  if (limit <= 0) return await req.text();
+
+  const length = Number(req.headers.get("content-length"));
+  if (length > limit) return null;
+
+  const chunks: Uint8Array[] = [];
+  let size = 0;
+  for await (const chunk of req.body) {
+    size += chunk.byteLength;
+    if (size > limit) return null;
+    chunks.push(chunk);
+  }
+  const bytes = new Uint8Array(size);
+  let offset = 0;
+  for (const chunk of chunks) {
+    bytes.set(chunk, offset);
+    offset += chunk.byteLength;
+  }
+  return new TextDecoder().decode(bytes);
+}
 
 export const handler: Deno.ServeHandler = async (
   req: Request,
+  info: Deno.ServeHandlerInfo,
 ): Promise<Response> => {
+  try {
+    return await runMiddleware(req, (req) => handle(req, info));
+  } catch (error) {
+    log.error("Unhandled error in handler:", error);
+    notifyError(error, { source: "handler", method: req.method, url: req.url });
+    return new Response("Internal Server Error", { status: 500 });
+  }
+};
+
+async function handle(
+  req: Request,
+  info: Deno.ServeHandlerInfo,
+): Promise<Response> {
   const url = new URL(req.url);
+  const ip = clientIp(req, info);
+  const dispatcher = getDispatcher();
+
+  const isInternal = url.pathname === PROXY_UPGRADE_PATH ||
+    url.pathname.startsWith(`${PROXY_UPGRADE_PATH}/`);
+  const ipFilter = isInternal ? wsIpFilter : proxyIpFilter;
+  if (!ipFilter.allows(ip)) {
+    return new Response("Forbidden", { status: 403 });
+  }
+
+  if (url.pathname.startsWith(`${ADMIN_PATH}/`)) {
+    const route = url.pathname.slice(ADMIN_PATH.length);
+    if (!isAdminAuthorized(req, url)) {
+      // Denied calls are audited, but not what they asked for.
+      await audit(ip, `${req.method} ${route}`, undefined, 401);
+      return new Response("Unauthorized", { status: 401 });
+    }
+    return await adminHandler(req, route, url, ip);
+  }
+
+  if (url.pathname === SCHEMA_PATH) {
+    return Response.json(protocolSchema);
+  }
 
   if (url.pathname === PROXY_UPGRADE_PATH) {
-    if (PASSWORD && url.searchParams.get("password") !== PASSWORD) {
+    if (!isAllowedOrigin(req)) {
+      log.warn(`Rejected client from origin ${req.headers.get("origin")}`);
+      return new Response("Forbidden", { status: 403 });
+    }
+    if (isAuthorized(req, url)) {
+      return PASSWORD
+        ? dispatcher.accept(req, "password", PASSWORD)
+        : dispatcher.accept(req, "anonymous");
+    }
+
+    // Proxy clients may also use a token minted through the admin API, or a
+    // JWT from the configured OpenID Connect issuer.
+    const secret = credential(req, url);
+    if (!secret) return new Response("Unauthorized", { status: 401 });
+
+    const tokenId = await findToken(secret);
+    if (tokenId) return dispatcher.accept(req, `token:${tokenId}`, secret);
+
+    const claims = await verifyJwt(secret);
+    if (!claims || typeof claims.sub !== "string") {
       return new Response("Unauthorized", { status: 401 });
     }
-    return ProxyManager.handler(req);
+    log.info(`Proxy client authenticated as ${claims.sub}`);
+    return dispatcher.accept(
+      req,
+      `oidc:${claims.sub}`,
+      secret,
+      jwtExpiry(claims),
+    );
+  }
+
+  if (!isProxyAuthorized(req) || !(await authenticate(req))) {
+    return new Response("Unauthorized", {
+      status: 401,
+      headers: PROXY_BASIC_AUTH
+        ? { "www-authenticate": 'Basic realm="ws_proxy"' }
+        : { "www-authenticate": "Bearer" },
+    });
   }
 
-  console.log(`Proxying request: ${req.method} ${url.pathname}${url.search}`);
+  if (!ALLOWED_METHODS.includes("*") && !ALLOWED_METHODS.includes(req.method)) {
+    return new Response("Method Not Allowed", {
+      status: 405,
+      headers: { allow: ALLOWED_METHODS.join(", ") },
+    });
+  }
+
+  // Policy is checked against the decoded path, the one the backend sees.
+  const decodedPath = decodePath(url.pathname);
+  if (isDeniedPath(decodedPath)) {
+    return new Response("Not Found", { status: 404 });
+  }
+
+  const route = matchRoute(url.hostname, decodedPath);
+  if (route?.methods && !route.methods.includes(req.method)) {
+    return new Response("Method Not Allowed", {
+      status: 405,
+      headers: { allow: route.methods.join(", ") },
+    });
+  }
+
+  if (inMaintenance()) {
+    return new Response("Under maintenance", {
+      status: 503,
+      headers: { "retry-after": String(RETRY_AFTER) },
+    });
+  }
+
+  // X-Wsproxy-Client pins the request to a specific client, for debugging
+  // one backend instance.
+  const pinnedClient = req.headers.get("x-wsproxy-client");
+  if (pinnedClient && pinnedClient !== dispatcher.client?.id) {
+    return new Response(`Proxy client ${pinnedClient} not connected`, {
+      status: 503,
+    });
+  }
+
+  if (!dispatcher.serves(url.hostname, decodedPath)) {
+    return new Response("Not Found", { status: 404 });
+  }
+
+  // Shed load before buffering the body once the server is saturated.
+  if (
+    MAX_CONCURRENT_REQUESTS > 0 &&
+    dispatcher.pendingCount + dispatcher.queuedCount >= MAX_CONCURRENT_REQUESTS
+  ) {
+    return new Response("Server busy", {
+      status: 503,
+      headers: { "retry-after": String(RETRY_AFTER) },
+    });
+  }
+
+  log.info(
+    `Proxying request: ${req.method} ${url.pathname}${url.search} from ${ip}`,
+  );
 
   const path = `${url.pathname}${url.search}`;
-  const body = req.body ? await req.text() : undefined;
+  const text = await readBody(req, route?.maxBodySize ?? MAX_BODY_SIZE);
+  if (text === null) {
+    return new Response("Payload Too Large", { status: 413 });
+  }
+  const body = req.body ? text : undefined;
+  await recordRequest(req, path, body);
 
-  return await ProxyManager.request(req.method, path, body);
-};
+  const debug = matchesDebugLog(path);
+  if (debug) logDebugRequest(req, path, body);
+
+  const stream = await dispatcher.request(
+    req.method,
+    path,
+    body,
+    req.headers,
+    {
+      headerTimeout: route?.headerTimeout,
+      totalTimeout: route?.totalTimeout,
+      maxResponseSize: route?.maxResponseSize,
+      contentType: route?.contentType,
+      keepAlive: route?.keepAlive,
+      priority: route?.priority ?? headerPriority(req),
+    },
+  );
+  let response = toResponse(stream);
+  if (route?.rewriteUrls) {
+    response = rewriteUrls(response, route.rewriteUrls, url.origin);
+  }
+  response = applyTransformers(response, route);
+  return debug ? logDebugResponse(path, response) : response;
+}
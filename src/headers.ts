@@ -0,0 +1,64 @@
+import { NOSNIFF } from "./env.ts";
+import { createLogger } from "./log.ts";
+
+const log = createLogger("headers");
+
+// Headers that describe a single connection rather than the response, and so
+// are never passed on.
+const HOP_BY_HOP = [
+  "connection",
+  "keep-alive",
+  "proxy-connection",
+  "te",
+  "trailer",
+  "transfer-encoding",
+  "upgrade",
+];
+
+/**
+ * Builds the caller's response headers from those sent by the client. The
+ * server frames the response itself, so hop-by-hop headers, including any
+ * Transfer-Encoding, are dropped, as is a Content-Length that isn't a single
+ * number. A valid Content-Length is kept and returned, so the body can be
+ * checked against it. Returns null if a header name or value isn't valid.
+ */
+export function responseHeaders(
+  uuid: string,
+  sent: Record<string, string>,
+): { headers: Headers; contentLength?: number } | null {
+  let headers: Headers;
+  try {
+    headers = new Headers(sent);
+  } catch (error) {
+    log.warn(`Invalid response headers from ${uuid}:`, error);
+    return null;
+  }
+
+  const connection = headers.get("connection") ?? "";
+  const dropped = [...HOP_BY_HOP, ...connection.split(",")]
+    .map((name) => name.trim().toLowerCase())
+    .filter(Boolean);
+  for (const name of dropped) headers.delete(name);
+
+  const length = headers.get("content-length");
+  if (length === null) return { headers };
+  if (!/^\d+$/.test(length.trim())) {
+    log.warn(`Dropping invalid Content-Length from ${uuid}: ${length}`);
+    headers.delete("content-length");
+    return { headers };
+  }
+  return { headers, contentLength: Number.parseInt(length) };
+}
+
+/**
+ * Labels responses the client sent without a Content-Type with
+ * `contentType`, if given, and tells browsers not to guess types when
+ * NOSNIFF is set. Deno never sniffs types itself, so unlabeled responses
+ * otherwise go out without one.
+ */
+export function applyContentType(headers: Headers, contentType?: string) {
+  if (contentType && !headers.has("content-type")) {
+    headers.set("content-type", contentType);
+  }
+  if (NOSNIFF) headers.set("x-content-type-options", "nosniff");
+}
@@ -0,0 +1,30 @@
+import { assertEquals } from "@std/assert";
+import { responseHeaders } from "./headers.ts";
+
+const uuid = "00000000-0000-4000-8000-000000000000";
+
+Deno.test("responseHeaders rejects invalid names and values", () => {
+  assertEquals(responseHeaders(uuid, { "bad name": "x" }), null);
+  assertEquals(responseHeaders(uuid, { "x-split": "a\r\nb: c" }), null);
+  assertEquals(responseHeaders(uuid, { "x-null": "a\0b" }), null);
+});
+
+Deno.test("responseHeaders drops hop-by-hop headers", () => {
+  const head = responseHeaders(uuid, {
+    "connection": "x-private",
+    "transfer-encoding": "chunked",
+    "x-private": "1",
+    "x-kept": "2",
+  });
+  assertEquals([...head!.headers.keys()], ["x-kept"]);
+});
+
+Deno.test("responseHeaders returns a valid Content-Length only", () => {
+  assertEquals(
+    responseHeaders(uuid, { "content-length": "42" })?.contentLength,
+    42,
+  );
+  const invalid = responseHeaders(uuid, { "content-length": "42, 42" });
+  assertEquals(invalid?.contentLength, undefined);
+  assertEquals(invalid?.headers.has("content-length"), false);
+});
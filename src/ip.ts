@@ -0,0 +1,123 @@
+function parseIPv4(ip: string): Uint8Array | null {
+  const parts = ip.split(".");
+  if (parts.length !== 4) return null;
+
+  const bytes = parts.map((part) =>
+    /^\d{1,3}$/.test(part) ? Number(part) : NaN
+  );
+  if (bytes.some((byte) => !(byte <= 255))) return null;
+  return new Uint8Array(bytes);
+}
+
+function parseIPv6Groups(text: string): number[] | null {
+  if (!text) return [];
+
+  const groups: number[] = [];
+  const parts = text.split(":");
+  for (const [i, part] of parts.entries()) {
+    if (i === parts.length - 1 && part.includes(".")) {
+      // Embedded IPv4 address, as in ::ffff:192.0.2.1
+      const v4 = parseIPv4(part);
+      if (!v4) return null;
+      groups.push(v4[0] << 8 | v4[1], v4[2] << 8 | v4[3]);
+    } else if (/^[0-9a-f]{1,4}$/i.test(part)) {
+      groups.push(Number.parseInt(part, 16));
+    } else {
+      return null;
+    }
+  }
+  return groups;
+}
+
+function parseIPv6(ip: string): Uint8Array | null {
+  const halves = ip.split("%")[0].split("::");
+  if (halves.length > 2) return null;
+
+  const head = parseIPv6Groups(halves[0]);
+  const tail = halves.length === 2 ? parseIPv6Groups(halves[1]) : [];
+  if (!head || !tail) return null;
+
+  const missing = 8 - head.length - tail.length;
+  if (halves.length === 1 ? missing !== 0 : missing < 1) return null;
+
+  const groups = [...head, ...new Array(missing).fill(0), ...tail];
+  return new Uint8Array(groups.flatMap((group) => [group >> 8, group & 0xff]));
+}
+
+/**
+ * Parses an IPv4 or IPv6 address into its bytes. IPv4-mapped IPv6
+ * addresses are returned as IPv4, so they match IPv4 ranges.
+ */
+export function parseIp(ip: string): Uint8Array | null {
+  const v4 = parseIPv4(ip);
+  if (v4) return v4;
+
+  const v6 = parseIPv6(ip);
+  if (!v6) return null;
+  const mapped = v6.subarray(0, 10).every((byte) => byte === 0) &&
+    v6[10] === 0xff && v6[11] === 0xff;
+  return mapped ? v6.slice(12) : v6;
+}
+
+export interface Cidr {
+  bytes: Uint8Array;
+  prefix: number;
+}
+
+/**
+ * Parses a CIDR range such as "10.0.0.0/8" or "fd00::/8". A bare address
+ * is a range containing only itself. Throws on invalid input.
+ */
+export function parseCidr(cidr: string): Cidr {
+  const [ip, prefixText] = cidr.split("/");
+  const bytes = parseIp(ip);
+  const prefix = prefixText === undefined
+    ? (bytes?.length ?? 0) * 8
+    : Number(prefixText);
+  if (
+    !bytes || !Number.isInteger(prefix) || prefix < 0 ||
+    prefix > bytes.length * 8
+  ) {
+    throw new Error(`Invalid CIDR: ${cidr}`);
+  }
+  return { bytes, prefix };
+}
+
+export function cidrContains(cidr: Cidr, ip: Uint8Array): boolean {
+  if (cidr.bytes.length !== ip.length) return false;
+
+  for (let bit = 0; bit < cidr.prefix; bit += 8) {
+    const mask = (0xff << (8 - Math.min(8, cidr.prefix - bit))) & 0xff;
+    if ((cidr.bytes[bit / 8] & mask) !== (ip[bit / 8] & mask)) return false;
+  }
+  return true;
+}
+
+export function matchesAny(cidrs: Cidr[], ip: string): boolean {
+  const bytes = parseIp(ip);
+  return !!bytes && cidrs.some((cidr) => cidrContains(cidr, bytes));
+}
+
+/**
+ * Allows or denies addresses by CIDR ranges. Deny entries win; when there
+ * are allow entries, an address must match one of them.
+ */
+export class IpFilter {
+  private allow: Cidr[];
+  private deny: Cidr[];
+
+  constructor(allow: string[], deny: string[]) {
+    this.allow = allow.map(parseCidr);
+    this.deny = deny.map(parseCidr);
+  }
+
+  allows(ip: string): boolean {
+    const bytes = parseIp(ip);
+    // Non-IP peers, like Unix sockets, are only subject to allow lists.
+    if (!bytes) return this.allow.length === 0;
+
+    if (this.deny.some((cidr) => cidrContains(cidr, bytes))) return false;
+    return this.allow.length === 0 ||
+      this.allow.some((cidr) => cidrContains(cidr, bytes));
+  }
+}
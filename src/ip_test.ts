@@ -0,0 +1,58 @@
+import { assertEquals, assertThrows } from "@std/assert";
+import {
+  cidrContains,
+  IpFilter,
+  matchesAny,
+  parseCidr,
+  parseIp,
+} from "./ip.ts";
+
+Deno.test("parseIp parses IPv4 and IPv6 addresses", () => {
+  assertEquals(parseIp("192.0.2.1"), new Uint8Array([192, 0, 2, 1]));
+  assertEquals(parseIp("::1")?.length, 16);
+  assertEquals(parseIp("fe80::1%eth0")?.[0], 0xfe);
+  for (const invalid of ["256.0.0.1", "1.2.3", "1::2::3", "::g", "host"]) {
+    assertEquals(parseIp(invalid), null);
+  }
+});
+
+Deno.test("parseIp returns IPv4-mapped addresses as IPv4", () => {
+  assertEquals(parseIp("::ffff:192.0.2.1"), new Uint8Array([192, 0, 2, 1]));
+});
+
+Deno.test("parseCidr rejects invalid ranges", () => {
+  for (const invalid of ["10.0.0.0/33", "10.0.0.0/-1", "fd00::/129", "x/8"]) {
+    assertThrows(() => parseCidr(invalid), Error, "Invalid CIDR");
+  }
+});
+
+Deno.test("cidrContains matches addresses inside the range", () => {
+  const contains = (cidr: string, ip: string) =>
+    cidrContains(parseCidr(cidr), parseIp(ip)!);
+  assertEquals(contains("10.0.0.0/8", "10.255.0.1"), true);
+  assertEquals(contains("192.168.1.0/25", "192.168.1.127"), true);
+  assertEquals(contains("192.168.1.0/25", "192.168.1.128"), false);
+  assertEquals(contains("fd00::/8", "fd12::1"), true);
+  assertEquals(contains("fd00::/8", "fe80::1"), false);
+  assertEquals(contains("203.0.113.7", "203.0.113.7"), true);
+  assertEquals(contains("203.0.113.7", "203.0.113.8"), false);
+  assertEquals(contains("10.0.0.0/8", "::ffff:10.1.2.3"), true);
+  assertEquals(contains("0.0.0.0/0", "::1"), false);
+});
+
+Deno.test("matchesAny matches an address in any of the ranges", () => {
+  const cidrs = ["10.0.0.0/8", "fd00::/8"].map(parseCidr);
+  assertEquals(matchesAny(cidrs, "10.1.2.3"), true);
+  assertEquals(matchesAny(cidrs, "fd00::1"), true);
+  assertEquals(matchesAny(cidrs, "192.0.2.1"), false);
+  assertEquals(matchesAny(cidrs, "local"), false);
+});
+
+Deno.test("IpFilter lets deny entries win over allow entries", () => {
+  const filter = new IpFilter(["10.0.0.0/8"], ["10.0.0.0/24"]);
+  assertEquals(filter.allows("10.1.0.1"), true);
+  assertEquals(filter.allows("10.0.0.1"), false);
+  assertEquals(filter.allows("192.0.2.1"), false);
+  assertEquals(filter.allows("local"), false);
+  assertEquals(new IpFilter([], ["10.0.0.0/8"]).allows("local"), true);
+});
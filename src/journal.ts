@@ -0,0 +1,122 @@
+import { JOURNAL_FILE } from "./env.ts";
+import { createLogger } from "./log.ts";
+
+const log = createLogger("journal");
+
+interface JournalEntry {
+  event: "accepted" | "finished";
+  uuid: string;
+  time: string;
+  method?: string;
+  path?: string;
+  clientId?: string;
+  outcome?: string;
+}
+
+/**
+ * A request that was accepted but never answered before the previous run
+ * of the server stopped.
+ */
+export interface InterruptedRequest {
+  uuid: string;
+  method: string;
+  path: string;
+  clientId: string;
+  acceptedAt: string;
+}
+
+let interrupted: InterruptedRequest[] = [];
+
+/**
+ * Reads the journal left by the previous run and starts a fresh one. Only
+ * the server calls this, at startup, so that other commands importing this
+ * module don't wipe the journal of a server that is running.
+ */
+export function recoverJournal() {
+  if (!JOURNAL_FILE) return;
+  let text = "";
+  try {
+    text = Deno.readTextFileSync(JOURNAL_FILE);
+  } catch (error) {
+    if (!(error instanceof Deno.errors.NotFound)) throw error;
+  }
+
+  const unfinished = new Map<string, InterruptedRequest>();
+  for (const line of text.split("\n")) {
+    if (!line) continue;
+    let entry: JournalEntry;
+    try {
+      entry = JSON.parse(line);
+    } catch {
+      // The last line may be cut short by a crash.
+      continue;
+    }
+    if (entry.event === "finished") {
+      unfinished.delete(entry.uuid);
+      continue;
+    }
+    unfinished.set(entry.uuid, {
+      uuid: entry.uuid,
+      method: entry.method ?? "",
+      path: entry.path ?? "",
+      clientId: entry.clientId ?? "",
+      acceptedAt: entry.time,
+    });
+  }
+  Deno.writeTextFileSync(JOURNAL_FILE, "");
+
+  for (const request of unfinished.values()) {
+    log.warn(
+      `Request ${request.uuid} (${request.method} ${request.path}) ` +
+        "was interrupted by a restart",
+    );
+  }
+  interrupted = [...unfinished.values()];
+}
+
+// The journal is rewritten with only the open requests once it has this
+// many lines, so it doesn't grow for as long as the server runs.
+const COMPACT_LINES = 10000;
+
+// Entries of requests that haven't finished yet.
+const open = new Map<string, JournalEntry>();
+let lines = 0;
+
+// Writes are chained so entries land in the order they were made.
+let writes = Promise.resolve();
+
+function append(entry: Omit<JournalEntry, "time">) {
+  if (!JOURNAL_FILE) return;
+  const line: JournalEntry = { ...entry, time: new Date().toISOString() };
+  if (line.event === "accepted") open.set(line.uuid, line);
+  else open.delete(line.uuid);
+
+  const compact = ++lines >= COMPACT_LINES;
+  if (compact) lines = open.size;
+  const text = compact
+    ? [...open.values()].map((entry) => JSON.stringify(entry) + "\n").join("")
+    : JSON.stringify(line) + "\n";
+  writes = writes
+    .then(() => Deno.writeTextFile(JOURNAL_FILE!, text, { append: !compact }))
+    .catch((error) => log.error("Failed to write journal:", error));
+}
+
+export function journalAccepted(
+  uuid: string,
+  method: string,
+  path: string,
+  clientId: string,
+) {
+  append({ event: "accepted", uuid, method, path, clientId });
+}
+
+export function journalFinished(uuid: string, outcome: string) {
+  append({ event: "finished", uuid, outcome });
+}
+
+/**
+ * Requests the previous run accepted but never answered.
+ */
+export function interruptedRequests(): InterruptedRequest[] {
+  return interrupted;
+}
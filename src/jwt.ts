@@ -0,0 +1,146 @@
+import { OIDC_AUDIENCE, OIDC_ISSUER, OIDC_JWKS_URL } from "./env.ts";
+import { createLogger } from "./log.ts";
+
+const log = createLogger("jwt");
+
+// Without an audience, any token the issuer signed for another application
+// would let its holder in.
+if (OIDC_ISSUER && !OIDC_AUDIENCE) {
+  throw new Error("OIDC_ISSUER requires OIDC_AUDIENCE to be set.");
+}
+
+const JWKS_TTL = 10 * 60 * 1000;
+// Tokens with an unknown kid force a refetch, but only this often, so
+// made-up tokens can't make the server hammer the issuer.
+const JWKS_REFETCH_COOLDOWN = 60 * 1000;
+const CLOCK_LEEWAY = 60;
+
+const ALGORITHMS: Record<string, {
+  importParams: RsaHashedImportParams | EcKeyImportParams;
+  verifyParams: AlgorithmIdentifier | EcdsaParams;
+}> = {
+  RS256: {
+    importParams: { name: "RSASSA-PKCS1-v1_5", hash: "SHA-256" },
+    verifyParams: "RSASSA-PKCS1-v1_5",
+  },
+  ES256: {
+    importParams: { name: "ECDSA", namedCurve: "P-256" },
+    verifyParams: { name: "ECDSA", hash: "SHA-256" },
+  },
+};
+
+interface Jwk extends JsonWebKey {
+  kid?: string;
+}
+
+let jwks: { keys: Jwk[]; fetchedAt: number } | null = null;
+let fetching: Promise<Jwk[]> | null = null;
+let lastFetch = 0; // When the keys were last fetched, successfully or not
+
+async function fetchJson(url: string) {
+  const res = await fetch(url);
+  if (!res.ok) throw new Error(`GET ${url} returned ${res.status}`);
+  return await res.json();
+}
+
+async function fetchKeys(): Promise<Jwk[]> {
+  const url = OIDC_JWKS_URL ?? (await fetchJson(
+    `${OIDC_ISSUER!.replace(/\/$/, "")}/.well-known/openid-configuration`,
+  )).jwks_uri;
+  jwks = { keys: (await fetchJson(url)).keys, fetchedAt: Date.now() };
+  return jwks.keys;
+}
+
+/**
+ * Returns the issuer's signing keys, from OIDC_JWKS_URL or OpenID Connect
+ * discovery, cached for ten minutes unless `refresh` is set. Fetches are
+ * shared, and at most one starts per JWKS_REFETCH_COOLDOWN; until then the
+ * cached keys are returned.
+ */
+async function signingKeys(refresh: boolean): Promise<Jwk[]> {
+  if (!refresh && jwks && Date.now() - jwks.fetchedAt < JWKS_TTL) {
+    return jwks.keys;
+  }
+  if (fetching) return await fetching;
+  if (Date.now() - lastFetch < JWKS_REFETCH_COOLDOWN) return jwks?.keys ?? [];
+
+  lastFetch = Date.now();
+  fetching = fetchKeys().finally(() => {
+    fetching = null;
+  });
+  return await fetching;
+}
+
+/**
+ * Returns when a verified token stops being accepted, in milliseconds since
+ * the epoch.
+ */
+export function jwtExpiry(claims: Record<string, unknown>): number {
+  return ((claims.exp as number) + CLOCK_LEEWAY) * 1000;
+}
+
+function base64UrlDecode(text: string) {
+  const base64 = text.replace(/-/g, "+").replace(/_/g, "/");
+  return Uint8Array.from(atob(base64), (char) => char.charCodeAt(0));
+}
+
+function decodeJson(text: string) {
+  return JSON.parse(new TextDecoder().decode(base64UrlDecode(text)));
+}
+
+/**
+ * Verifies a JWT from OIDC_ISSUER: its signature against the issuer's keys,
+ * and its iss, aud, exp and nbf claims. Returns the claims, or null if the
+ * token is not valid or no issuer is configured.
+ */
+export async function verifyJwt(
+  token: string,
+): Promise<Record<string, unknown> | null> {
+  if (!OIDC_ISSUER) return null;
+
+  const parts = token.split(".");
+  if (parts.length !== 3) return null;
+
+  try {
+    const header = decodeJson(parts[0]);
+    const claims = decodeJson(parts[1]);
+    const algorithm = ALGORITHMS[header.alg];
+    if (!algorithm) return null;
+
+    const findKey = (keys: Jwk[]) =>
+      keys.find((key) => header.kid === undefined || key.kid === header.kid);
+    const jwk = findKey(await signingKeys(false)) ??
+      findKey(await signingKeys(true));
+    if (!jwk) return null;
+
+    const key = await crypto.subtle.importKey(
+      "jwk",
+      jwk,
+      algorithm.importParams,
+      false,
+      ["verify"],
+    );
+    const valid = await crypto.subtle.verify(
+      algorithm.verifyParams,
+      key,
+      base64UrlDecode(parts[2]),
+      new TextEncoder().encode(`${parts[0]}.${parts[1]}`),
+    );
+    if (!valid) return null;
+
+    const now = Date.now() / 1000;
+    const audiences = [claims.aud].flat();
+    if (
+      claims.iss !== OIDC_ISSUER ||
+      !audiences.includes(OIDC_AUDIENCE) ||
+      typeof claims.exp !== "number" || claims.exp + CLOCK_LEEWAY < now ||
+      (typeof claims.nbf === "number" && claims.nbf - CLOCK_LEEWAY > now)
+    ) {
+      return null;
+    }
+    return claims;
+  } catch (error) {
+    log.warn("Failed to verify JWT:", error);
+    return null;
+  }
+}
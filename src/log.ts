@@ -0,0 +1,224 @@
+import {
+  LOG_FILE,
+  LOG_LEVEL,
+  LOG_LEVELS,
+  LOG_MAX_FILES,
+  LOG_MAX_SIZE,
+  LOG_TARGET,
+  SYSLOG_ADDRESS,
+} from "./env.ts";
+
+const LEVELS = ["debug", "info", "warn", "error"] as const;
+type Level = typeof LEVELS[number];
+
+export interface Logger {
+  debug(...args: unknown[]): void;
+  info(...args: unknown[]): void;
+  warn(...args: unknown[]): void;
+  error(...args: unknown[]): void;
+}
+
+// Syslog severities, also understood by journald as "<N>" line prefixes.
+const SEVERITY: Record<Level, number> = {
+  debug: 7,
+  info: 6,
+  warn: 4,
+  error: 3,
+};
+
+const textEncoder = new TextEncoder();
+
+// Only TCP syslog is supported: UDP and /dev/log need Deno's unstable
+// datagram API.
+if (LOG_TARGET === "syslog") {
+  throw new Error(
+    "LOG_TARGET=syslog is now syslog-tcp; UDP and /dev/log aren't supported.",
+  );
+}
+
+function isLevel(value: unknown): value is Level {
+  return LEVELS.includes(value as Level);
+}
+
+let defaultLevel: Level = isLevel(LOG_LEVEL) ? LOG_LEVEL : "info";
+const componentLevels = new Map<string, Level>();
+for (const entry of LOG_LEVELS.split(",").filter(Boolean)) {
+  const [component, level] = entry.split("=").map((part) => part.trim());
+  if (isLevel(level)) componentLevels.set(component, level);
+}
+
+export interface LogLevels {
+  default: Level;
+  components: Record<string, Level>;
+}
+
+export function getLogLevels(): LogLevels {
+  return {
+    default: defaultLevel,
+    components: Object.fromEntries(componentLevels),
+  };
+}
+
+/**
+ * Changes the default and per-component levels at runtime. A component set
+ * to null falls back to the default again. Throws on unknown levels.
+ */
+export function setLogLevels(update: {
+  default?: string;
+  components?: Record<string, string | null>;
+}) {
+  const levels = [update.default, ...Object.values(update.components ?? {})];
+  for (const level of levels) {
+    if (level !== undefined && level !== null && !isLevel(level)) {
+      throw new Error(`Unknown log level: ${level}`);
+    }
+  }
+
+  if (update.default !== undefined) defaultLevel = update.default as Level;
+  for (const [component, level] of Object.entries(update.components ?? {})) {
+    if (level === null) componentLevels.delete(component);
+    else componentLevels.set(component, level as Level);
+  }
+}
+
+let file: Deno.FsFile | null = null;
+let fileSize = 0;
+
+function openLogFile(path: string) {
+  file?.close();
+  file = Deno.openSync(path, { create: true, append: true });
+  fileSize = file.statSync().size;
+}
+
+/**
+ * Shifts LOG_FILE to LOG_FILE.1, LOG_FILE.1 to LOG_FILE.2 and so on,
+ * dropping the oldest, and starts a new LOG_FILE.
+ */
+function rotate(path: string) {
+  file?.close();
+  file = null;
+  for (let i = Math.max(LOG_MAX_FILES, 1) - 1; i >= 1; i--) {
+    try {
+      Deno.renameSync(`${path}.${i}`, `${path}.${i + 1}`);
+    } catch {
+      // No such backup yet.
+    }
+  }
+  Deno.renameSync(path, `${path}.1`);
+  openLogFile(path);
+}
+
+function writeToFile(line: string) {
+  if (!LOG_FILE) return;
+
+  try {
+    if (!file) openLogFile(LOG_FILE);
+    const bytes = textEncoder.encode(line);
+    if (
+      LOG_MAX_SIZE > 0 && fileSize > 0 &&
+      fileSize + bytes.length > LOG_MAX_SIZE
+    ) {
+      rotate(LOG_FILE);
+    }
+    file!.writeSync(bytes);
+    fileSize += bytes.length;
+  } catch (error) {
+    console.error("Failed to write log file:", error);
+  }
+}
+
+function format(args: unknown[]): string {
+  return args.map((arg) => typeof arg === "string" ? arg : Deno.inspect(arg))
+    .join(" ");
+}
+
+function writeToJournald(level: Level, component: string, args: unknown[]) {
+  const line = `<${SEVERITY[level]}>[${component}] ${format(args)}\n`;
+  Deno.stderr.writeSync(textEncoder.encode(line));
+}
+
+let syslogConn: Deno.TcpConn | null = null;
+let syslogQueue = Promise.resolve();
+let hostname: string | undefined;
+
+/**
+ * Sends an RFC 5424 message to SYSLOG_ADDRESS over TCP, using octet
+ * counting framing so multi-line messages stay intact. Messages are written
+ * in order; on failure they fall back to the console and the connection is
+ * retried with the next message.
+ */
+function writeToSyslog(level: Level, component: string, args: unknown[]) {
+  hostname ??= Deno.hostname();
+  const message = `<${8 + SEVERITY[level]}>1 ${new Date().toISOString()} ` +
+    `${hostname} ws_proxy ${Deno.pid} ${component} - ${format(args)}`;
+  const body = textEncoder.encode(message);
+  const frame = new Uint8Array([
+    ...textEncoder.encode(`${body.length} `),
+    ...body,
+  ]);
+
+  syslogQueue = syslogQueue.then(async () => {
+    try {
+      if (!syslogConn) {
+        const [host, port] = SYSLOG_ADDRESS.split(":");
+        syslogConn = await Deno.connect({
+          hostname: host,
+          port: Number.parseInt(port ?? "514"),
+        });
+      }
+      for (let written = 0; written < frame.length;) {
+        written += await syslogConn.write(frame.subarray(written));
+      }
+    } catch (error) {
+      syslogConn?.close();
+      syslogConn = null;
+      console.error("Failed to write to syslog:", error);
+      console[level](...args);
+    }
+  });
+}
+
+/**
+ * Reopens LOG_FILE on SIGUSR2, so external tools like logrotate can move
+ * the file away. Set LOG_MAX_SIZE to 0 to leave rotation to them entirely.
+ */
+export function watchLogFile() {
+  if (!LOG_FILE || Deno.build.os === "windows") return;
+
+  const path = LOG_FILE;
+  Deno.addSignalListener("SIGUSR2", () => openLogFile(path));
+}
+
+/**
+ * Creates a logger whose messages go to LOG_TARGET and, when LOG_FILE is
+ * set, to that file with a timestamp, level and component. With `always`
+ * set, the configured levels are ignored, for records like the audit trail.
+ */
+export function createLogger(component: string, always = false): Logger {
+  const write = (level: Level, args: unknown[]) => {
+    const threshold = componentLevels.get(component) ?? defaultLevel;
+    if (!always && LEVELS.indexOf(level) < LEVELS.indexOf(threshold)) return;
+
+    switch (LOG_TARGET) {
+      case "journald":
+        writeToJournald(level, component, args);
+        break;
+      case "syslog-tcp":
+        writeToSyslog(level, component, args);
+        break;
+      default:
+        console[level](...args);
+    }
+    const time = new Date().toISOString();
+    writeToFile(
+      `${time} ${level.toUpperCase()} [${component}] ${format(args)}\n`,
+    );
+  };
+
+  return {
+    debug: (...args) => write("debug", args),
+    info: (...args) => write("info", args),
+    warn: (...args) => write("warn", args),
+    error: (...args) => write("error", args),
+  };
+}
@@ -0,0 +1,13 @@
+let enabled = false;
+
+/**
+ * Whether the server is in maintenance mode, answering proxied requests
+ * with a 503 while clients and the admin API keep working.
+ */
+export function inMaintenance(): boolean {
+  return enabled;
+}
+
+export function setMaintenance(on: boolean) {
+  enabled = on;
+}
@@ -0,0 +1,156 @@
+import { METRICS_MAX_CLIENTS } from "./env.ts";
+import { usageReport } from "./usage.ts";
+
+// Upper bounds of the latency histogram buckets, in seconds.
+const BUCKETS = [0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30];
+
+interface Histogram {
+  counts: number[]; // Per bucket, not cumulative; the last is +Inf
+  sum: number;
+  count: number;
+}
+
+// Usage counters exported per identity, see usage.ts.
+const USAGE_COUNTERS = [
+  ["requests", "requests", "Requests dispatched"],
+  ["responses", "responses", "Requests that received response headers"],
+  ["errors", "errors", "Requests that timed out or were dropped"],
+  ["bytesIn", "received_bytes", "Response body bytes received"],
+  ["bytesOut", "sent_bytes", "Request body bytes sent"],
+] as const;
+
+const latencies = new Map<string, Histogram>();
+const protocolErrors = new Map<string, number>();
+
+/**
+ * Returns the label for a client identity in `series`. Past
+ * METRICS_MAX_CLIENTS identities, new ones share the "other" label, so the
+ * number of series stays bounded.
+ */
+function labelFor(series: Map<string, unknown>, identity: string): string {
+  return series.has(identity) || series.size < METRICS_MAX_CLIENTS
+    ? identity
+    : "other";
+}
+
+function histogramFor(identity: string): Histogram {
+  const label = labelFor(latencies, identity);
+  let histogram = latencies.get(label);
+  if (!histogram) {
+    histogram = {
+      counts: new Array(BUCKETS.length + 1).fill(0),
+      sum: 0,
+      count: 0,
+    };
+    latencies.set(label, histogram);
+  }
+  return histogram;
+}
+
+/**
+ * Records the time until response headers for a request served by a client
+ * with the given identity, see ProxyManager.accept.
+ */
+export function observeLatency(identity: string, seconds: number) {
+  const histogram = histogramFor(identity);
+  const bucket = BUCKETS.findIndex((bound) => seconds <= bound);
+  histogram.counts[bucket === -1 ? BUCKETS.length : bucket]++;
+  histogram.sum += seconds;
+  histogram.count++;
+}
+
+/**
+ * Counts a malformed message from a client.
+ */
+export function countProtocolError(identity: string) {
+  const label = labelFor(protocolErrors, identity);
+  protocolErrors.set(label, (protocolErrors.get(label) ?? 0) + 1);
+}
+
+/**
+ * Drops the series of an identity once no client with it is connected.
+ */
+export function forgetClient(identity: string) {
+  latencies.delete(identity);
+  protocolErrors.delete(identity);
+}
+
+/**
+ * Escapes a label value for the text format, as identities include JWT
+ * subjects, which may contain backslashes, quotes or newlines.
+ */
+function escapeLabel(value: string): string {
+  return value.replace(/\\/g, "\\\\").replace(/"/g, '\\"')
+    .replace(/\n/g, "\\n");
+}
+
+/**
+ * Sums the usage counters by label, sharing "other" past METRICS_MAX_CLIENTS
+ * identities like the other series.
+ */
+function usageByLabel() {
+  const series = new Map<string, Record<string, number>>();
+  for (const entry of usageReport()) {
+    const label = labelFor(series, entry.identity);
+    const counters = series.get(label) ?? {};
+    for (const [field] of USAGE_COUNTERS) {
+      counters[field] = (counters[field] ?? 0) + entry[field];
+    }
+    series.set(label, counters);
+  }
+  return series;
+}
+
+/**
+ * Renders the latency histograms, the protocol error and usage counters and
+ * the given gauges in the Prometheus text format.
+ */
+export function renderMetrics(gauges: Record<string, number>): string {
+  const lines: string[] = [];
+  for (const [name, value] of Object.entries(gauges)) {
+    lines.push(`# TYPE ws_proxy_${name} gauge`, `ws_proxy_${name} ${value}`);
+  }
+
+  const name = "ws_proxy_response_latency_seconds";
+  lines.push(
+    `# HELP ${name} Time until response headers, by proxy client.`,
+    `# TYPE ${name} histogram`,
+  );
+  for (const [identity, histogram] of latencies) {
+    const client = escapeLabel(identity);
+    let cumulative = 0;
+    BUCKETS.forEach((bound, i) => {
+      cumulative += histogram.counts[i];
+      lines.push(
+        `${name}_bucket{client="${client}",le="${bound}"} ${cumulative}`,
+      );
+    });
+    lines.push(
+      `${name}_bucket{client="${client}",le="+Inf"} ${histogram.count}`,
+      `${name}_sum{client="${client}"} ${histogram.sum}`,
+      `${name}_count{client="${client}"} ${histogram.count}`,
+    );
+  }
+
+  const errors = "ws_proxy_protocol_errors_total";
+  lines.push(
+    `# HELP ${errors} Malformed messages, by proxy client.`,
+    `# TYPE ${errors} counter`,
+  );
+  for (const [identity, count] of protocolErrors) {
+    const client = escapeLabel(identity);
+    lines.push(`${errors}{client="${client}"} ${count}`);
+  }
+
+  const usage = usageByLabel();
+  for (const [field, suffix, help] of USAGE_COUNTERS) {
+    const name = `ws_proxy_client_${suffix}_total`;
+    lines.push(`# HELP ${name} ${help}, by proxy client.`);
+    lines.push(`# TYPE ${name} counter`);
+    for (const [identity, counters] of usage) {
+      const client = escapeLabel(identity);
+      lines.push(`${name}{client="${client}"} ${counters[field]}`);
+    }
+  }
+  return lines.join("\n") + "\n";
+}
@@ -0,0 +1,10 @@
+import { assertStringIncludes } from "@std/assert";
+import { countProtocolError, renderMetrics } from "./metrics.ts";
+
+Deno.test("renderMetrics escapes client labels", () => {
+  countProtocolError('oidc:a\\b"c\nd');
+  assertStringIncludes(
+    renderMetrics({}),
+    'ws_proxy_protocol_errors_total{client="oidc:a\\\\b\\"c\\nd"} 1',
+  );
+});
@@ -0,0 +1,77 @@
+import { parseArgs } from "@std/cli/parse-args";
+import { parse } from "@std/yaml";
+import { connectClient, sendGoodbye, sendResponse } from "./client.ts";
+import { HOSTNAME, PASSWORD, PORT } from "./env.ts";
+
+interface MockResponse {
+  status?: number;
+  headers?: Record<string, string>;
+  body?: string;
+  delay?: number; // Milliseconds to wait before responding
+}
+
+/**
+ * Connects as a proxy client that answers requests with canned responses
+ * from a YAML file mapping paths to responses, e.g.
+ *
+ *     /hello:
+ *       status: 200
+ *       headers: { content-type: text/plain }
+ *       body: Hello, world!
+ *       delay: 100
+ *
+ * Paths are matched without the query string; a "*" entry matches anything
+ * else. Unmatched requests get a 404.
+ */
+export async function runMockClient(args: string[]) {
+  const flags = parseArgs(args, {
+    string: ["target", "password"],
+    default: { target: `http://${HOSTNAME}:${PORT}`, password: PASSWORD ?? "" },
+  });
+  const file = flags._[0];
+  if (file === undefined) {
+    console.error(
+      "Usage: main.ts mockclient <file> [--target URL] [--password PASSWORD]",
+    );
+    Deno.exit(1);
+  }
+
+  const mocks = parse(await Deno.readTextFile(String(file))) as Record<
+    string,
+    MockResponse
+  >;
+
+  let chunkSize: number | undefined;
+  const socket = await connectClient(
+    flags.target,
+    flags.password,
+    async (client, request) => {
+      const pathname = new URL(request.path, "http://localhost").pathname;
+      const mock = mocks[pathname] ?? mocks["*"];
+      const status = mock ? mock.status ?? 200 : 404;
+      console.log(`${request.method} ${request.path} -> ${status}`);
+
+      const delay = mock?.delay ?? 0;
+      if (delay > 0) await new Promise((r) => setTimeout(r, delay));
+      sendResponse(client, request.uuid, {
+        status,
+        headers: mock?.headers ?? {},
+        body: mock ? mock.body ?? "" : "Not Found",
+      }, chunkSize);
+    },
+    (client, config) => {
+      if (config.logLevel || config.targetBaseUrl) {
+        throw new Error("Mock client has no log level or target");
+      }
+      console.log("Config pushed:", config);
+      chunkSize = config.chunkSize ?? chunkSize;
+      if (config.drain) sendGoodbye(client, "Drain requested");
+    },
+  );
+  console.log(`Mock client connected to ${flags.target}.`);
+  // Drain instead of dropping in-flight requests on Ctrl-C.
+  Deno.addSignalListener("SIGINT", () => sendGoodbye(socket, "Interrupted"));
+
+  await new Promise((resolve) => socket.addEventListener("close", resolve));
+  console.log("Mock client disconnected.");
+}
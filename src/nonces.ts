@@ -0,0 +1,48 @@
+import { REPLAY_WINDOW } from "./env.ts";
+import { ProxyMessageUnion } from "./types.ts";
+
+// Seen nonces and when they can be forgotten, in insertion (and so expiry)
+// order.
+const seenNonces = new Map<string, number>();
+
+/**
+ * Adds a timestamp and nonce to the message when `window`, REPLAY_WINDOW by
+ * default, is set. Stamp before signing, so the signature covers both.
+ */
+export function stampMessage<T extends ProxyMessageUnion>(
+  message: T,
+  window = REPLAY_WINDOW,
+): T {
+  if (window <= 0) return message;
+  return { ...message, timestamp: Date.now(), nonce: crypto.randomUUID() };
+}
+
+/**
+ * Rejects messages whose timestamp is more than `window` seconds off,
+ * REPLAY_WINDOW by default, or whose nonce has been seen before. Nonces are
+ * remembered for long enough that a replay would fail the timestamp check
+ * instead.
+ */
+export function isFreshMessage(
+  message: ProxyMessageUnion,
+  window = REPLAY_WINDOW,
+): boolean {
+  if (window <= 0) return true;
+
+  const now = Date.now();
+  for (const [nonce, expiry] of seenNonces) {
+    if (expiry > now) break;
+    seenNonces.delete(nonce);
+  }
+
+  if (
+    typeof message.timestamp !== "number" ||
+    typeof message.nonce !== "string" ||
+    Math.abs(now - message.timestamp) > window * 1000 ||
+    seenNonces.has(message.nonce)
+  ) {
+    return false;
+  }
+  seenNonces.set(message.nonce, now + 2 * window * 1000);
+  return true;
+}
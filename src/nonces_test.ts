@@ -0,0 +1,36 @@
+import { assertEquals } from "@std/assert";
+import { isFreshMessage, stampMessage } from "./nonces.ts";
+import { ProxyResponseChunk } from "./types.ts";
+
+const WINDOW = 30;
+
+const message: ProxyResponseChunk = {
+  type: "response-chunk",
+  uuid: "0b4a6c1e-2f3d-4e5a-8b9c-0d1e2f3a4b5c",
+  data: "hello",
+  isFinal: true,
+};
+
+Deno.test("isFreshMessage accepts a stamped message only once", () => {
+  const stamped = stampMessage(message, WINDOW);
+  assertEquals(typeof stamped.nonce, "string");
+  assertEquals(isFreshMessage(stamped, WINDOW), true);
+  assertEquals(isFreshMessage(stamped, WINDOW), false);
+  assertEquals(isFreshMessage(stampMessage(message, WINDOW), WINDOW), true);
+});
+
+Deno.test("isFreshMessage rejects unstamped and stale messages", () => {
+  assertEquals(isFreshMessage(message, WINDOW), false);
+  const stamped = stampMessage(message, WINDOW);
+  for (const skew of [-31_000, 31_000]) {
+    assertEquals(
+      isFreshMessage({ ...stamped, timestamp: Date.now() + skew }, WINDOW),
+      false,
+    );
+  }
+});
+
+Deno.test("stampMessage and isFreshMessage do nothing without a window", () => {
+  assertEquals(stampMessage(message, 0), message);
+  assertEquals(isFreshMessage(message, 0), true);
+});
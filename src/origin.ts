@@ -0,0 +1,41 @@
+import { ALLOWED_ORIGINS } from "./env.ts";
+
+/**
+ * Decides whether a proxy client connecting from a browser page at
+ * `origin` may connect. Requests without an Origin header come from
+ * non-browser clients and are not checked.
+ */
+export type OriginCheck = (origin: string, req: Request) => boolean;
+
+/**
+ * Allows everything when `allowed` is empty, otherwise origins matching one
+ * of its entries, where "*" matches any characters, e.g.
+ * "https://*.example.com".
+ */
+export function matchOrigins(allowed: string[]): OriginCheck {
+  const patterns = allowed.map((pattern) =>
+    new RegExp(
+      `^${
+        pattern.split("*")
+          .map((part) => part.replace(/[.+?^${}()|[\]\\/]/g, "\\$&"))
+          .join(".*")
+      }$`,
+    )
+  );
+  return (origin) =>
+    patterns.length === 0 || patterns.some((pattern) => pattern.test(origin));
+}
+
+let originCheck = matchOrigins(ALLOWED_ORIGINS);
+
+/**
+ * Replaces the origin policy, for embedders with their own rules.
+ */
+export function setOriginCheck(check: OriginCheck) {
+  originCheck = check;
+}
+
+export function isAllowedOrigin(req: Request): boolean {
+  const origin = req.headers.get("origin");
+  return origin === null || originCheck(origin, req);
+}
@@ -0,0 +1,32 @@
+import { assertEquals } from "@std/assert";
+import { isAllowedOrigin, matchOrigins, setOriginCheck } from "./origin.ts";
+
+const request = (origin?: string) =>
+  new Request("http://localhost/__ws_proxy", {
+    headers: origin ? { origin } : {},
+  });
+
+Deno.test("matchOrigins matches wildcard patterns", () => {
+  const check = matchOrigins([
+    "https://*.example.com",
+    "http://localhost:3000",
+  ]);
+  const allows = (origin: string) => check(origin, request(origin));
+  assertEquals(allows("https://app.example.com"), true);
+  assertEquals(allows("http://localhost:3000"), true);
+  assertEquals(allows("https://example.com"), false);
+  assertEquals(allows("https://app.example.com.evil"), false);
+  assertEquals(allows("http://localhost:30000"), false);
+});
+
+Deno.test("matchOrigins allows everything when empty", () => {
+  assertEquals(matchOrigins([])("https://any.test", request()), true);
+});
+
+Deno.test("isAllowedOrigin applies the origin check", () => {
+  setOriginCheck((origin) => origin === "https://other.test");
+  assertEquals(isAllowedOrigin(request("https://other.test")), true);
+  assertEquals(isAllowedOrigin(request("https://app.example.com")), false);
+  // Requests without an Origin header come from non-browser clients.
+  assertEquals(isAllowedOrigin(request()), true);
+});
@@ -0,0 +1,6 @@
+// Paths the server reserves for itself. Kept apart from handler.ts so the
+// client-side commands can use them without loading the server.
+
+export const PROXY_UPGRADE_PATH = "/__ws_proxy";
+export const ADMIN_PATH = `${PROXY_UPGRADE_PATH}/admin`;
+export const SCHEMA_PATH = `${PROXY_UPGRADE_PATH}/schema`;
@@ -0,0 +1,90 @@
+import { setBus } from "./bus.ts";
+import { setDispatcher } from "./dispatcher.ts";
+import { PLUGINS } from "./env.ts";
+import { setErrorReporter } from "./errors.ts";
+import { createLogger } from "./log.ts";
+import { setOriginCheck } from "./origin.ts";
+import { registerTransformer } from "./transformers.ts";
+
+const log = createLogger("plugins");
+
+/**
+ * Decides whether a caller may use the proxied endpoint, on top of
+ * PROXY_BASIC_AUTH and PROXY_BEARER_TOKEN.
+ */
+export type Authenticator = (req: Request) => boolean | Promise<boolean>;
+
+/**
+ * Wraps the handling of every request, calling `next` to continue.
+ */
+export type Middleware = (
+  req: Request,
+  next: (req: Request) => Promise<Response>,
+) => Promise<Response>;
+
+/**
+ * What plugins get to extend the server with. A plugin is a module whose
+ * default export is a function taking this API, e.g.
+ *
+ *     export default (api: PluginApi) => api.use(async (req, next) => ...);
+ */
+export interface PluginApi {
+  registerTransformer: typeof registerTransformer;
+  setBus: typeof setBus;
+  setDispatcher: typeof setDispatcher;
+  setErrorReporter: typeof setErrorReporter;
+  setOriginCheck: typeof setOriginCheck;
+  addAuthenticator(authenticator: Authenticator): void;
+  use(middleware: Middleware): void;
+}
+
+const authenticators: Authenticator[] = [];
+const middlewares: Middleware[] = [];
+
+const api: PluginApi = {
+  registerTransformer,
+  setBus,
+  setDispatcher,
+  setErrorReporter,
+  setOriginCheck,
+  addAuthenticator: (authenticator) => authenticators.push(authenticator),
+  use: (middleware) => middlewares.push(middleware),
+};
+
+/**
+ * Imports and registers the modules in PLUGINS, in order. Paths are
+ * relative to the working directory; URLs and npm: or jsr: specifiers are
+ * imported as is.
+ */
+export async function loadPlugins() {
+  for (const specifier of PLUGINS) {
+    const url = new URL(specifier, `file://${Deno.cwd()}/`).href;
+    const plugin = await import(url);
+    await plugin.default(api);
+    log.info(`Loaded plugin ${specifier}`);
+  }
+}
+
+/**
+ * Checks the caller against every plugin authenticator.
+ */
+export async function authenticate(req: Request): Promise<boolean> {
+  for (const authenticator of authenticators) {
+    if (!(await authenticator(req))) return false;
+  }
+  return true;
+}
+
+/**
+ * Runs the request through the plugin middleware, then `handle`.
+ */
+export function runMiddleware(
+  req: Request,
+  handle: (req: Request) => Promise<Response>,
+): Promise<Response> {
+  const run = (index: number, req: Request): Promise<Response> =>
+    index < middlewares.length
+      ? middlewares[index](req, (next) => run(index + 1, next))
+      : handle(req);
+  return run(0, req);
+}
@@ -1,8 +1,91 @@
+import { clientTopic, getBus } from "./bus.ts";
+import { negotiate, SUBPROTOCOLS } from "./capabilities.ts";
 import {
+  beginCapture,
+  captureFrame,
+  captureMessage,
+  endCapture,
+} from "./capture.ts";
+import { applyChaos } from "./chaos.ts";
+import { isAllowedDestination } from "./destinations.ts";
+import {
+  ACK_TIMEOUT,
+  ALLOWED_DESTINATIONS,
+  HEADER_TIMEOUT,
+  MAX_IN_FLIGHT,
+  MAX_MESSAGE_SIZE,
+  MAX_RESPONSE_SIZE,
+  MEMORY_BUDGET,
+  PROTOCOL_ERROR_ACTION,
+  PROTOCOL_ERROR_LIMIT,
+  PROTOCOL_ERROR_WINDOW,
+  QUEUE_DEADLINE,
+  QUEUE_OVERFLOW,
+  QUEUE_SIZE,
+  REQUIRE_SUBPROTOCOL,
+  RETRY_AFTER,
+  SERVER_TIMING,
+  SIGN_MESSAGES,
+  SLOW_REQUEST_THRESHOLD,
+  TOTAL_TIMEOUT,
+  UPSTREAM_IDLE_TIMEOUT,
+  UPSTREAM_KEEP_ALIVE,
+  WS_IDLE_TIMEOUT,
+  WS_READ_TIMEOUT,
+  WS_WRITE_TIMEOUT,
+} from "./env.ts";
+import { notifyError } from "./errors.ts";
+import { decodeChunkFrame } from "./frames.ts";
+import { applyContentType, responseHeaders } from "./headers.ts";
+import { journalAccepted, journalFinished } from "./journal.ts";
+import { createLogger } from "./log.ts";
+import {
+  countProtocolError,
+  forgetClient,
+  observeLatency,
+} from "./metrics.ts";
+import type { ClientConn, DispatcherStats } from "./dispatcher.ts";
+import { isFreshMessage, stampMessage } from "./nonces.ts";
+import { DispatchQueue } from "./queue.ts";
+import {
+  deriveSigningKey,
+  signMessage,
+  verifyMessage,
+} from "./signing.ts";
+import { tailEnd, tailHeaders, tailStart } from "./tail.ts";
+import { requestTimings, serverTiming, TimingMarks } from "./timing.ts";
+import {
+  AnnouncedRoute,
+  Capabilities,
+  ClientConfig,
+  ClientHealth,
   ProxyMessageUnion,
   ProxyRequest,
-  ProxyResponseHeaders,
+  ProxyResponseChunk,
 } from "./types.ts";
+import { usageConnected, usageDisconnected, usageFor } from "./usage.ts";
+import { isUuid, parseMessage } from "./validate.ts";
+import { notifyWebhooks } from "./webhooks.ts";
+
+const log = createLogger("proxy");
+
+/**
+ * A failed proxy request, answered to the caller with `status`.
+ */
+class ProxyError extends Error {
+  constructor(message: string, readonly status: number) {
+    super(message);
+  }
+}
+
+/**
+ * The status line and headers of a response, as passed on to the caller.
+ */
+interface ResponseHead {
+  status: number;
+  statusText: string;
+  headers: Headers;
+}
 
 /**
  * Defines the structure for a request that is waiting for a response.
@@ -10,120 +93,993 @@ import {
  * and the controller for the response body's ReadableStream.
  */
 interface PendingRequest {
-  resolveHeaders: (headers: ProxyResponseHeaders) => void;
+  clientId: string;
+  socket: WebSocket;
+  method: string;
+  path: string;
+  status?: number;
+  bytesSent: number;
+  bytesReceived: number;
+  contentLength?: number; // Announced by the client, checked at the end
+  maxResponseSize: number;
+  marks: TimingMarks;
+  resolveHeaders: (head: ResponseHead) => void;
   reject: (reason?: unknown) => void;
   streamController: ReadableStreamDefaultController<Uint8Array>;
+  totalTimeout?: number;
+  ackTimeout?: number;
+}
+
+// Statuses whose responses never have a body.
+const NULL_BODY_STATUSES = [204, 205, 304];
+
+// The longest delay setTimeout supports, about 24.8 days.
+const MAX_TIMER_DELAY = 2 ** 31 - 1;
+
+/**
+ * Whether a response has no body, so it is complete once headers arrive.
+ */
+function isBodiless(method: string, status: number): boolean {
+  return method === "HEAD" || NULL_BODY_STATUSES.includes(status);
+}
+
+/**
+ * The last configuration pushed to a client and whether it was applied.
+ */
+export interface ConfigPush {
+  uuid: string;
+  config: ClientConfig;
+  status: "pending" | "applied" | "rejected";
+  error?: string;
+  sentAt: string;
+  ackedAt?: string;
+}
+
+export interface RequestOptions {
+  headerTimeout?: number; // Seconds, defaults to HEADER_TIMEOUT
+  totalTimeout?: number; // Seconds, defaults to TOTAL_TIMEOUT; 0 for none
+  maxResponseSize?: number; // Bytes, defaults to MAX_RESPONSE_SIZE
+  contentType?: string; // Default Content-Type of the response
+  keepAlive?: boolean; // Defaults to UPSTREAM_KEEP_ALIVE
+  priority?: number; // Higher is dispatched first when the client is busy
 }
 
 export class ProxyManager {
   private static socket: WebSocket | null = null;
+  private static clientId: string | null = null;
+  // The identity each connected client authenticated as, see accept().
+  private static identities = new Map<string, string>();
+  // The key each connected client's messages are signed with, derived from
+  // the credential it connected with.
+  private static signingKeys = new Map<string, Promise<string>>();
+  // Features negotiated with each connected client.
+  private static negotiated = new Map<string, Capabilities>();
+  private static health: (ClientHealth & { receivedAt: string }) | null =
+    null;
   private static textEncoder = new TextEncoder();
 
   // A simple Map to track requests by their UUID.
   private static pendingRequests = new Map<string, PendingRequest>();
 
+  // Write deadlines of sockets with unsent data.
+  private static writeTimers = new WeakMap<WebSocket, number>();
+
+  // Clients that said goodbye, closed once their requests are done.
+  private static draining = new Map<string, WebSocket>();
+
+  // Times of recent protocol errors of each client, and clients that had
+  // too many and get no new requests.
+  private static protocolErrorTimes = new Map<string, number[]>();
+  private static quarantined = new Set<string>();
+
+  // Routes announced by each connected client in its hello.
+  private static announcedRoutes = new Map<string, AnnouncedRoute[]>();
+
+  // The last configuration pushed to each connected client.
+  private static configPushes = new Map<string, ConfigPush>();
+
+  // Every pending request holds a slot, released in finishRequest.
+  static dispatchQueue = new DispatchQueue(
+    MAX_IN_FLIGHT,
+    QUEUE_SIZE,
+    QUEUE_OVERFLOW,
+    QUEUE_DEADLINE,
+  );
+
   /**
-   * The central message handler. It receives all messages from the client,
-   * looks up the corresponding pending request, and routes the data.
+   * Removes a request from the pending map once its response has been
+   * fully delivered or abandoned by the caller.
    */
-  private static handleMessage(event: MessageEvent) {
-    try {
-      const message: ProxyMessageUnion = JSON.parse(event.data);
-      if (!message.uuid) return;
+  private static finishRequest(uuid: string, outcome: string) {
+    const pending = this.pendingRequests.get(uuid);
+    if (!pending) return;
 
-      const pending = this.pendingRequests.get(message.uuid);
-      if (!pending) {
-        console.warn(
-          `Received message for unknown request UUID: ${message.uuid}`,
-        );
+    this.pendingRequests.delete(uuid);
+    this.dispatchQueue.release();
+    clearTimeout(pending.totalTimeout);
+    clearTimeout(pending.ackTimeout);
+    endCapture(uuid, outcome);
+    pending.marks.end = performance.now();
+    const timings = requestTimings(pending.marks);
+    log.debug(`Request ${uuid} ${outcome}:`, timings);
+    tailEnd(uuid, outcome, timings);
+    journalFinished(uuid, outcome);
+
+    const duration = pending.marks.end - pending.marks.start;
+    if (
+      SLOW_REQUEST_THRESHOLD > 0 && duration > SLOW_REQUEST_THRESHOLD * 1000
+    ) {
+      log.warn(`Slow request ${uuid}: ${pending.method} ${pending.path}`, {
+        clientId: pending.clientId,
+        status: pending.status,
+        outcome,
+        duration,
+        timings,
+        bytesSent: pending.bytesSent,
+        bytesReceived: pending.bytesReceived,
+      });
+    }
+    this.closeIfDrained(pending.clientId);
+  }
+
+  /**
+   * Closes a draining client's socket once it has no pending requests.
+   */
+  private static closeIfDrained(clientId: string) {
+    const socket = this.draining.get(clientId);
+    if (!socket) return;
+    for (const pending of this.pendingRequests.values()) {
+      if (pending.clientId === clientId) return;
+    }
+    this.draining.delete(clientId);
+    socket.close(1000, "Drained");
+  }
+
+  /**
+   * Removes a request from the pending map, failing both its headers
+   * promise and its response stream with `error`.
+   */
+  private static failRequest(uuid: string, error: Error, outcome: string) {
+    const pending = this.pendingRequests.get(uuid);
+    if (!pending) return;
+
+    this.finishRequest(uuid, outcome);
+    pending.reject(error);
+    pending.streamController.error(error);
+  }
+
+  /**
+   * Dispatches a message to a client over the bus.
+   */
+  private static async send(clientId: string, message: ProxyMessageUnion) {
+    await getBus().publish(clientTopic(clientId), { clientId, message });
+  }
+
+  /**
+   * Signs and writes a message from the bus to a client's socket.
+   */
+  private static async deliver(
+    socket: WebSocket,
+    clientId: string,
+    message: ProxyMessageUnion,
+  ) {
+    const key = this.signingKeys.get(clientId);
+    socket.send(JSON.stringify(await signMessage(stampMessage(message), key)));
+    this.checkWriteDeadline(socket);
+  }
+
+  /**
+   * Disconnects a client that hasn't taken the data queued for it within
+   * WS_WRITE_TIMEOUT seconds.
+   */
+  private static checkWriteDeadline(socket: WebSocket) {
+    if (WS_WRITE_TIMEOUT <= 0 || this.writeTimers.has(socket)) return;
+    if (socket.bufferedAmount === 0) return;
+
+    this.writeTimers.set(
+      socket,
+      setTimeout(() => {
+        this.writeTimers.delete(socket);
+        if (socket.bufferedAmount === 0) return;
+        log.warn("Proxy client is not reading, disconnecting.");
+        socket.close(1001, "Write timeout");
+      }, WS_WRITE_TIMEOUT * 1000),
+    );
+  }
+
+  /**
+   * Tells the client working on a request to give up on it.
+   */
+  private static cancelRequest(
+    pending: PendingRequest,
+    uuid: string,
+    reason: string,
+  ) {
+    if (pending.socket.readyState !== WebSocket.OPEN) return;
+    this.send(pending.clientId, { type: "cancel", uuid, reason })
+      .catch((error) => log.error(`Failed to cancel ${uuid}:`, error));
+  }
+
+  /**
+   * Tells a client what was wrong with a message it sent, `ref` being that
+   * message's UUID if it had a valid one.
+   */
+  private static sendProtocolError(
+    clientId: string,
+    problem: string,
+    ref?: string,
+  ) {
+    log.warn(`Protocol error from ${clientId}: ${problem}`);
+    countProtocolError(this.identityOf(clientId));
+    this.scoreProtocolError(clientId);
+    this.send(clientId, {
+      type: "protocol-error",
+      uuid: crypto.randomUUID(),
+      error: problem,
+      ref,
+    }).catch((error) => log.error("Failed to send protocol error:", error));
+  }
+
+  /**
+   * Quarantines or disconnects a client once it has sent more than
+   * PROTOCOL_ERROR_LIMIT malformed messages within PROTOCOL_ERROR_WINDOW.
+   */
+  private static scoreProtocolError(clientId: string) {
+    if (PROTOCOL_ERROR_LIMIT <= 0 || this.quarantined.has(clientId)) return;
+    const now = Date.now();
+    const times = (this.protocolErrorTimes.get(clientId) ?? [])
+      .filter((time) => time > now - PROTOCOL_ERROR_WINDOW * 1000);
+    times.push(now);
+    this.protocolErrorTimes.set(clientId, times);
+    if (times.length <= PROTOCOL_ERROR_LIMIT) return;
+
+    if (PROTOCOL_ERROR_ACTION === "disconnect") {
+      log.warn(`Disconnecting client ${clientId}: too many protocol errors`);
+      const socket = this.clientId === clientId
+        ? this.socket
+        : this.draining.get(clientId);
+      socket?.close(1008, "Too many protocol errors");
+      return;
+    }
+    log.warn(`Quarantining client ${clientId}: too many protocol errors`);
+    this.quarantined.add(clientId);
+  }
+
+  /**
+   * Parses a message from the client and checks its signature and
+   * freshness before handing it to handleMessage.
+   */
+  private static async receive(
+    data: string,
+    socket: WebSocket,
+    clientId: string,
+  ) {
+    const parsed = parseMessage(data);
+    if (parsed.error !== undefined) {
+      const { error, uuid } = parsed;
+      this.sendProtocolError(clientId, error, uuid);
+      // Don't leave the caller waiting on a response that can't be read.
+      const pending = uuid && this.pendingRequests.get(uuid);
+      if (pending && pending.clientId === clientId) {
+        this.abortRequest(pending, uuid, "Malformed response");
+      }
+      return;
+    }
+    const { message } = parsed;
+    if (!(await verifyMessage(message, this.signingKeys.get(clientId)))) {
+      log.warn(`Dropping message with invalid signature: ${message.uuid}`);
+      return;
+    }
+    if (!isFreshMessage(message)) {
+      log.warn(`Dropping stale or replayed message: ${message.uuid}`);
+      return;
+    }
+    switch (message.type) {
+      case "hello": {
+        const capabilities = negotiate(message.capabilities ?? {});
+        log.info(`Client ${clientId} capabilities:`, capabilities);
+        this.negotiated.set(clientId, capabilities);
+        if (message.routes) {
+          log.info(`Client ${clientId} serves:`, message.routes);
+          this.announcedRoutes.set(clientId, message.routes);
+        }
+        await this.send(clientId, {
+          type: "hello-ack",
+          uuid: message.uuid,
+          capabilities,
+        });
+        return;
+      }
+
+      case "heartbeat":
+        log.debug(`Heartbeat from ${clientId}:`, message.health);
+        if (this.clientId === clientId) {
+          this.health = {
+            ...message.health,
+            receivedAt: new Date().toISOString(),
+          };
+        }
+        return;
+
+      case "config-ack": {
+        const push = this.configPushes.get(clientId);
+        if (push?.uuid !== message.uuid) return;
+        push.status = message.ok ? "applied" : "rejected";
+        push.error = message.error;
+        push.ackedAt = new Date().toISOString();
+        if (!message.ok) {
+          log.warn(`Client ${clientId} rejected config: ${message.error}`);
+        }
         return;
       }
 
+      case "goodbye":
+        log.info(`Client ${clientId} is draining: ${message.reason ?? ""}`);
+        this.draining.set(clientId, socket);
+        this.closeIfDrained(clientId);
+        return;
+    }
+    this.handleMessage(message, clientId);
+  }
+
+  /**
+   * Looks up the request a client's message is about. Clients may only
+   * answer requests dispatched to them.
+   */
+  private static pendingFor(
+    uuid: string,
+    clientId: string,
+  ): PendingRequest | undefined {
+    const pending = this.pendingRequests.get(uuid);
+    if (!pending) {
+      log.warn(`Received message for unknown request UUID: ${uuid}`);
+      return;
+    }
+    if (pending.clientId !== clientId) {
+      log.warn(`Client ${clientId} sent a message for ${uuid}, not its own`);
+      return;
+    }
+    return pending;
+  }
+
+  /**
+   * The central message handler. It receives all messages from the client,
+   * looks up the corresponding pending request, and routes the data.
+   */
+  private static handleMessage(message: ProxyMessageUnion, clientId: string) {
+    try {
+      const pending = this.pendingFor(message.uuid, clientId);
+      if (!pending) return;
+      captureMessage(message.uuid, "in", message);
+      // Any message about a request shows the client received it.
+      clearTimeout(pending.ackTimeout);
+
       switch (message.type) {
-        case "response-headers":
-          pending.resolveHeaders(message);
+        case "response-headers": {
+          if (
+            ALLOWED_DESTINATIONS.length > 0 &&
+            !isAllowedDestination(message.destination ?? "")
+          ) {
+            log.warn(
+              `Request ${message.uuid} fetched disallowed destination: ` +
+                `${message.destination ?? "(not reported)"}`,
+            );
+            this.failRequest(
+              message.uuid,
+              new ProxyError("Destination not allowed", 502),
+              "disallowed destination",
+            );
+            break;
+          }
+          // Any three-digit final status is passed through, but informational
+          // ones can't be the answer to a request.
+          if (
+            !Number.isInteger(message.status) ||
+            message.status < 200 || message.status > 599
+          ) {
+            this.failRequest(
+              message.uuid,
+              new ProxyError(
+                `Invalid status from client: ${message.status}`,
+                502,
+              ),
+              "invalid status",
+            );
+            break;
+          }
+          const head = responseHeaders(message.uuid, message.headers);
+          if (!head) {
+            this.abortRequest(
+              pending,
+              message.uuid,
+              "Invalid response headers",
+            );
+            break;
+          }
+          const { headers, contentLength } = head;
+          pending.contentLength = contentLength;
+          pending.marks.headers = performance.now();
+          pending.status = message.status;
+          tailHeaders(message.uuid, message.status);
+          pending.resolveHeaders({
+            status: message.status,
+            statusText: message.statusText,
+            headers,
+          });
+          // Don't wait for a final chunk that has nothing to carry.
+          if (isBodiless(pending.method, message.status)) {
+            pending.streamController.close();
+            this.finishRequest(message.uuid, "completed");
+          }
+          break;
+        }
+
+        case "request-ack":
           break;
 
         case "response-chunk": {
-          if (message.data) {
-            pending.streamController.enqueue(
-              this.textEncoder.encode(message.data),
-            );
+          log.debug(
+            `Chunk for ${message.uuid}: ${message.data?.length ?? 0} chars` +
+              (message.isFinal ? " (final)" : ""),
+          );
+          const maxChunkSize = this.maxChunkSize(clientId);
+          if (maxChunkSize > 0 && (message.data?.length ?? 0) > maxChunkSize) {
+            this.abortRequest(pending, message.uuid, "Chunk too large");
+            break;
           }
-          if (message.isFinal) {
-            pending.streamController.close();
-            // The request is complete, clean up the map.
-            this.pendingRequests.delete(message.uuid);
+          let bytes: Uint8Array;
+          try {
+            bytes = this.decodeChunk(message);
+          } catch {
+            this.abortRequest(pending, message.uuid, "Invalid response chunk");
+            break;
           }
+          this.handleChunk(pending, message.uuid, bytes, message.isFinal);
           break;
         }
       }
     } catch (error) {
-      console.error("Failed to parse or handle proxy message:", error);
+      log.error("Failed to handle proxy message:", error);
+      notifyError(error, { source: "protocol" });
     }
   }
 
-  private static handle(req: Request): Response {
+  /**
+   * Passes a chunk of the response body on to the caller, checking it
+   * against the response's size limit and announced length.
+   */
+  private static handleChunk(
+    pending: PendingRequest,
+    uuid: string,
+    bytes: Uint8Array,
+    isFinal: boolean,
+  ) {
+    if (bytes.byteLength > 0) {
+      this.usageOf(pending.clientId).bytesIn += bytes.byteLength;
+      pending.bytesReceived += bytes.byteLength;
+      if (
+        pending.maxResponseSize > 0 &&
+        pending.bytesReceived > pending.maxResponseSize
+      ) {
+        // Abort the caller's response rather than truncate it.
+        this.abortRequest(pending, uuid, "Response too large");
+        return;
+      }
+      pending.streamController.enqueue(bytes);
+    }
+    if (
+      pending.contentLength !== undefined &&
+      (pending.bytesReceived > pending.contentLength ||
+        (isFinal && pending.bytesReceived !== pending.contentLength))
+    ) {
+      // Abort rather than send a body that contradicts its length.
+      this.abortRequest(pending, uuid, "Response length mismatch");
+      return;
+    }
+    if (isFinal) {
+      pending.streamController.close();
+      // The request is complete, clean up the map.
+      this.finishRequest(uuid, "completed");
+    }
+  }
+
+  /**
+   * Handles a binary chunk frame from a client that negotiated them.
+   */
+  private static receiveFrame(buffer: ArrayBuffer, clientId: string) {
+    if (MAX_MESSAGE_SIZE > 0 && buffer.byteLength > MAX_MESSAGE_SIZE) {
+      this.sendProtocolError(
+        clientId,
+        `Frame larger than ${MAX_MESSAGE_SIZE} bytes`,
+      );
+      return;
+    }
+    if (!this.negotiated.get(clientId)?.binaryFrames) {
+      log.warn(`Dropping binary frame from ${clientId}, not negotiated`);
+      return;
+    }
+    const frame = decodeChunkFrame(buffer);
+    if (!frame || !isUuid(frame.uuid)) {
+      this.sendProtocolError(clientId, "Malformed binary frame");
+      return;
+    }
+
+    const pending = this.pendingFor(frame.uuid, clientId);
+    if (!pending) return;
+    captureFrame(frame);
+    log.debug(
+      `Frame for ${frame.uuid}: ${frame.data.byteLength} bytes` +
+        (frame.isFinal ? " (final)" : ""),
+    );
+    const maxChunkSize = this.maxChunkSize(clientId);
+    if (maxChunkSize > 0 && frame.data.byteLength > maxChunkSize) {
+      this.abortRequest(pending, frame.uuid, "Chunk too large");
+      return;
+    }
+    this.handleChunk(pending, frame.uuid, frame.data, frame.isFinal);
+  }
+
+  /**
+   * Fails a request with a 502, or aborts its response if already under
+   * way, and tells the client to stop working on it.
+   */
+  private static abortRequest(
+    pending: PendingRequest,
+    uuid: string,
+    reason: string,
+  ) {
+    log.warn(`Aborting ${uuid}: ${reason}`);
+    this.failRequest(uuid, new ProxyError(reason, 502), reason.toLowerCase());
+    this.cancelRequest(pending, uuid, reason);
+  }
+
+  /**
+   * Returns the bytes of a chunk, which are passed on as is, so compressed
+   * and other binary bodies arrive intact when sent as base64.
+   */
+  private static decodeChunk(message: ProxyResponseChunk): Uint8Array {
+    if (message.encoding === "base64") {
+      return Uint8Array.from(atob(message.data), (char) => char.charCodeAt(0));
+    }
+    return this.textEncoder.encode(message.data);
+  }
+
+  /**
+   * Upgrades the request to the proxy client WebSocket. `identity` is who
+   * it authenticated as: "password", "anonymous" when no password is set,
+   * "token:<id>" for a client token or "oidc:<sub>" for a JWT. `secret` is
+   * the password, token or JWT itself, from which the key its messages are
+   * signed with is derived. The client is disconnected at `expiresAt` if
+   * set, when its JWT runs out.
+   */
+  private static handle(
+    req: Request,
+    identity = "anonymous",
+    secret?: string,
+    expiresAt?: number,
+  ): Response {
     if (req.headers.get("upgrade") !== "websocket") {
       return new Response("Expected websocket upgrade", { status: 426 });
     }
+    // Anonymous clients have nothing to derive a signing key from.
+    if (SIGN_MESSAGES && !secret) {
+      log.warn("Rejected client without a credential to sign messages with");
+      return new Response("Message signing requires a credential", {
+        status: 401,
+      });
+    }
+
+    // Clients that offer subprotocols must offer one we speak. Those that
+    // offer none are accepted unless REQUIRE_SUBPROTOCOL is set.
+    const offered = (req.headers.get("sec-websocket-protocol") ?? "")
+      .split(",").map((protocol) => protocol.trim()).filter(Boolean);
+    const protocol = SUBPROTOCOLS.find((supported) =>
+      offered.includes(supported)
+    );
+    if (!protocol && (offered.length > 0 || REQUIRE_SUBPROTOCOL)) {
+      log.warn(`Rejected client offering subprotocols: ${offered.join(", ")}`);
+      return new Response(
+        `Unsupported subprotocol, expected ${SUBPROTOCOLS.join(" or ")}`,
+        { status: 400 },
+      );
+    }
 
     if (this.isConnected) {
       this.socket?.close(1000, "New connection established");
     }
 
-    const { socket, response } = Deno.upgradeWebSocket(req);
+    const { socket, response } = Deno.upgradeWebSocket(req, {
+      protocol,
+      idleTimeout: WS_IDLE_TIMEOUT,
+    });
+    const clientId = crypto.randomUUID();
+    const requestId = req.headers.get("x-request-id") ?? undefined;
     this.socket = socket;
+    this.clientId = clientId;
+    this.identities.set(clientId, identity);
+    if (SIGN_MESSAGES) {
+      this.signingKeys.set(clientId, deriveSigningKey(secret!));
+    }
+    this.health = null;
+    usageConnected(identity, clientId);
+
+    // Disconnect clients that go quiet for longer than WS_READ_TIMEOUT.
+    let readTimer: number | undefined;
+    const resetReadTimer = () => {
+      clearTimeout(readTimer);
+      if (WS_READ_TIMEOUT <= 0) return;
+      readTimer = setTimeout(() => {
+        log.warn("Proxy client went quiet, disconnecting.");
+        socket.close(1001, "Read timeout");
+      }, WS_READ_TIMEOUT * 1000);
+    };
+
+    // Disconnect clients once their credential expires. Timers can't wait
+    // longer than 2^31 - 1 ms, so long waits are split up.
+    let expiryTimer: number | undefined;
+    const scheduleExpiry = (at: number) => {
+      const delay = Math.max(at - Date.now(), 0);
+      expiryTimer = setTimeout(() => {
+        if (delay > MAX_TIMER_DELAY) return scheduleExpiry(at);
+        log.info(`Credential of ${identity} expired, disconnecting.`);
+        socket.close(1008, "Credential expired");
+      }, Math.min(delay, MAX_TIMER_DELAY));
+    };
+    if (expiresAt !== undefined) scheduleExpiry(expiresAt);
 
-    socket.onopen = () => console.log("Proxy client connected.");
-    socket.onmessage = (event) => this.handleMessage(event);
-    socket.onerror = (e) => console.error("Proxy client error:", e);
-    socket.onclose = () => {
-      console.log("Proxy client disconnected.");
-      // When the client disconnects, fail all pending requests.
-      for (const [_uuid, pending] of this.pendingRequests.entries()) {
-        pending.reject(new Error("Proxy client disconnected."));
-        pending.streamController.error(
+    // Messages for this client arrive over the bus, whoever sent them.
+    const unsubscribe = getBus().subscribe(
+      clientTopic(clientId),
+      ({ message }) => this.deliver(socket, clientId, message),
+    );
+
+    socket.onopen = () => {
+      log.info("Proxy client connected.");
+      notifyWebhooks({ event: "connected", clientId, identity, requestId });
+      resetReadTimer();
+    };
+    // Messages are processed one at a time, in order, even though checking
+    // signatures is asynchronous.
+    let inbound = Promise.resolve();
+    socket.binaryType = "arraybuffer";
+    socket.onmessage = (event) =>
+      applyChaos(socket, event.data, (data: string | ArrayBuffer) => {
+        resetReadTimer();
+        inbound = inbound
+          .then(() =>
+            typeof data === "string"
+              ? this.receive(data, socket, clientId)
+              : this.receiveFrame(data, clientId)
+          )
+          .catch((error) => log.error("Failed to receive message:", error));
+      });
+    socket.onerror = (e) => log.error("Proxy client error:", e);
+    socket.onclose = (event) => {
+      log.info("Proxy client disconnected.");
+      clearTimeout(readTimer);
+      clearTimeout(expiryTimer);
+      clearTimeout(this.writeTimers.get(socket));
+      unsubscribe();
+      notifyWebhooks({
+        event: "disconnected",
+        clientId,
+        identity,
+        requestId,
+        reason: event.reason || `Close code ${event.code}`,
+      });
+      this.draining.delete(clientId);
+      this.protocolErrorTimes.delete(clientId);
+      this.quarantined.delete(clientId);
+      this.negotiated.delete(clientId);
+      this.configPushes.delete(clientId);
+      this.announcedRoutes.delete(clientId);
+      // When the client disconnects, fail its pending requests.
+      for (const [uuid, pending] of this.pendingRequests) {
+        if (pending.clientId !== clientId) continue;
+        this.failRequest(
+          uuid,
           new Error("Proxy client disconnected."),
+          "client disconnected",
         );
       }
-      this.pendingRequests.clear();
-      this.socket = null;
+      // A draining client may close after its replacement connected.
+      if (this.socket === socket) {
+        this.socket = null;
+        this.clientId = null;
+      }
+      usageDisconnected(identity, clientId);
+      this.identities.delete(clientId);
+      this.signingKeys.delete(clientId);
+      if (![...this.identities.values()].includes(identity)) {
+        forgetClient(identity);
+      }
     };
 
     return response;
   }
 
   static handler = this.handle.bind(this);
+  static accept = this.handler;
 
+  /**
+   * Whether there is a client to dispatch requests to. A draining or
+   * quarantined client still has an open socket but takes no new requests.
+   */
   static get isConnected(): boolean {
-    return this.socket !== null && this.socket.readyState === WebSocket.OPEN;
+    return this.socket !== null &&
+      this.socket.readyState === WebSocket.OPEN &&
+      !this.draining.has(this.clientId!) &&
+      !this.quarantined.has(this.clientId!);
+  }
+
+  static get currentClientId(): string | null {
+    return this.clientId;
+  }
+
+  /**
+   * Whether the current client is quarantined for sending too many
+   * malformed messages.
+   */
+  static get isQuarantined(): boolean {
+    return this.quarantined.has(this.clientId ?? "");
+  }
+
+  /**
+   * Features negotiated with the current client.
+   */
+  static get clientCapabilities(): Capabilities {
+    // Clients that never say hello get no optional features.
+    return this.negotiated.get(this.clientId ?? "") ?? {};
+  }
+
+  /**
+   * The current client's last heartbeat, if it has sent one.
+   */
+  static get clientHealth(): (ClientHealth & { receivedAt: string }) | null {
+    return this.health;
+  }
+
+  /**
+   * The client new requests go to, or null if none is connected.
+   */
+  static get client(): ClientConn | null {
+    if (!this.isConnected) return null;
+    return {
+      id: this.clientId!,
+      capabilities: this.clientCapabilities,
+      health: this.health,
+    };
+  }
+
+  static get queuedCount(): number {
+    return this.dispatchQueue.depth;
+  }
+
+  static stats(): DispatcherStats {
+    return {
+      connected: this.isConnected,
+      clientId: this.clientId,
+      quarantined: this.isQuarantined,
+      capabilities: this.clientCapabilities,
+      routes: this.routeTable,
+      health: this.health,
+      pendingRequests: this.pendingCount,
+      queuedRequests: this.queuedCount,
+      shedRequests: this.dispatchQueue.shed,
+      bufferedBytes: this.bufferedBytes,
+    };
+  }
+
+  /**
+   * The chunk size a client agreed to in its hello, or 0 if it never said
+   * hello or named no limit. Clients are only held to a limit they agreed to.
+   */
+  private static maxChunkSize(clientId: string): number {
+    return this.negotiated.get(clientId)?.maxChunkSize ?? 0;
+  }
+
+  /**
+   * The identity a client authenticated as, see handle().
+   */
+  private static identityOf(clientId: string): string {
+    return this.identities.get(clientId) ?? "anonymous";
+  }
+
+  private static usageOf(clientId: string) {
+    return usageFor(this.identityOf(clientId));
+  }
+
+  /**
+   * Disconnects the client if it authenticated with the given token.
+   */
+  static disconnectToken(tokenId: string) {
+    if (this.identities.get(this.clientId ?? "") === `token:${tokenId}`) {
+      this.socket?.close(1008, "Token revoked");
+    }
+  }
+
+  /**
+   * Disconnects the current client, failing its pending requests. Returns
+   * false if no client is connected.
+   */
+  static kick(): boolean {
+    if (!this.socket) return false;
+    log.info(`Disconnecting client ${this.clientId}`);
+    this.socket.close(1000, "Disconnected by admin");
+    return true;
+  }
+
+  /**
+   * Drains the current client as if it had said goodbye: it gets no new
+   * requests and is closed once its pending ones are done. Returns false if
+   * no client is connected.
+   */
+  static drain(): boolean {
+    if (!this.isConnected) return false;
+    log.info(`Draining client ${this.clientId}`);
+    this.draining.set(this.clientId!, this.socket!);
+    this.closeIfDrained(this.clientId!);
+    return true;
+  }
+
+  /**
+   * Tells the current client to close its pooled upstream connections.
+   * Returns false if no client is connected.
+   */
+  static async flushPools(host?: string): Promise<boolean> {
+    if (!this.isConnected) return false;
+    await this.send(this.clientId!, {
+      type: "flush-pools",
+      uuid: crypto.randomUUID(),
+      host,
+    });
+    return true;
+  }
+
+  /**
+   * Whether the current client serves requests for `host` and `pathname`.
+   * Clients that announced no routes serve everything.
+   */
+  static serves(host: string, pathname: string): boolean {
+    const routes = this.clientId && this.announcedRoutes.get(this.clientId);
+    if (!routes) return true;
+    return routes.some((route) =>
+      pathname.startsWith(route.prefix) &&
+      (!route.host || route.host.toLowerCase() === host.toLowerCase())
+    );
+  }
+
+  /**
+   * The routes announced by each connected client.
+   */
+  static get routeTable(): Record<string, AnnouncedRoute[]> {
+    return Object.fromEntries(this.announcedRoutes);
+  }
+
+  /**
+   * Pushes settings to the current client. Returns the push, whose status
+   * changes once the client acks it, or null if no client is connected.
+   */
+  static async pushConfig(config: ClientConfig): Promise<ConfigPush | null> {
+    if (!this.isConnected) return null;
+    const push: ConfigPush = {
+      uuid: crypto.randomUUID(),
+      config,
+      status: "pending",
+      sentAt: new Date().toISOString(),
+    };
+    this.configPushes.set(this.clientId!, push);
+    await this.send(this.clientId!, {
+      type: "config",
+      uuid: push.uuid,
+      config,
+    });
+    return push;
+  }
+
+  /**
+   * The last configuration pushed to each connected client.
+   */
+  static get configStatus(): Record<string, ConfigPush> {
+    return Object.fromEntries(this.configPushes);
+  }
+
+  static get pendingCount(): number {
+    return this.pendingRequests.size;
+  }
+
+  /**
+   * Bytes of response bodies received from clients but not yet taken by
+   * callers. Response streams have a high-water mark of 0 bytes, so each
+   * one's desired size is minus its backlog.
+   */
+  static get bufferedBytes(): number {
+    let total = 0;
+    for (const pending of this.pendingRequests.values()) {
+      total -= Math.min(0, pending.streamController.desiredSize ?? 0);
+    }
+    return total;
   }
 
   static async request(
     method: string,
     path: string,
     body?: string,
+    requestHeaders: Headers = new Headers(),
+    options: RequestOptions = {},
   ): Promise<Response> {
     if (!this.isConnected) {
       return new Response("Proxy client not connected", { status: 503 });
     }
 
+    // There is no backpressure on the client socket, so the only way to
+    // bound buffering is to take on no more work while callers catch up.
+    if (MEMORY_BUDGET > 0 && this.bufferedBytes > MEMORY_BUDGET) {
+      log.warn("Memory budget exceeded, shedding request.");
+      return new Response("Server busy", {
+        status: 503,
+        headers: { "retry-after": String(RETRY_AFTER) },
+      });
+    }
+
+    const marks: TimingMarks = { start: performance.now() };
+    if (!(await this.dispatchQueue.acquire(options.priority ?? 0))) {
+      return new Response("Proxy client busy", {
+        status: 503,
+        headers: { "retry-after": String(RETRY_AFTER) },
+      });
+    }
+    // The client may have gone away while the request was queued.
+    if (!this.isConnected) {
+      this.dispatchQueue.release();
+      return new Response("Proxy client not connected", { status: 503 });
+    }
+    marks.admitted = performance.now();
+
     const uuid = crypto.randomUUID();
+    const clientId = this.clientId!;
+    const usage = this.usageOf(clientId);
+    const headerTimeout = options.headerTimeout ?? HEADER_TIMEOUT;
+    const totalTimeout = options.totalTimeout ?? TOTAL_TIMEOUT;
+    const maxResponseSize = options.maxResponseSize ?? MAX_RESPONSE_SIZE;
+    const socket = this.socket!;
+    const bytesSent = body ? this.textEncoder.encode(body).byteLength : 0;
     let responseStream: ReadableStream<Uint8Array>;
 
-    const headersPromise = new Promise<ProxyResponseHeaders>(
+    const headersPromise = new Promise<ResponseHead>(
       (resolve, reject) => {
         const timeout = setTimeout(() => {
           // Clean up and reject if the client doesn't send headers in time.
-          this.pendingRequests.delete(uuid);
-          reject(new Error("Proxy request timed out waiting for headers."));
-        }, 900e3); // 15 minutes timeout
+          this.failRequest(
+            uuid,
+            new Error("Proxy request timed out waiting for headers."),
+            "timed out",
+          );
+        }, headerTimeout * 1000);
+
+        // Abort the response, even mid-stream, once it takes too long.
+        const totalTimer = totalTimeout > 0
+          ? setTimeout(() => {
+            this.failRequest(
+              uuid,
+              new Error("Proxy request timed out."),
+              "timed out",
+            );
+          }, totalTimeout * 1000)
+          : undefined;
 
         responseStream = new ReadableStream({
           start: (controller) => {
             // Store the callbacks and controller in our map.
             this.pendingRequests.set(uuid, {
+              clientId,
+              socket,
+              method,
+              path,
+              bytesSent,
+              bytesReceived: 0,
+              maxResponseSize,
+              marks,
               resolveHeaders: (headers) => {
                 clearTimeout(timeout);
                 resolve(headers);
@@ -133,14 +1089,17 @@ export class ProxyManager {
                 reject(reason);
               },
               streamController: controller,
+              totalTimeout: totalTimer,
             });
           },
           cancel: () => {
             // If the consumer of the response cancels reading, clean up.
-            console.log(`Request ${uuid} stream cancelled.`);
-            this.pendingRequests.delete(uuid);
+            log.info(`Request ${uuid} stream cancelled.`);
+            const pending = this.pendingRequests.get(uuid);
+            this.finishRequest(uuid, "cancelled");
+            if (pending) this.cancelRequest(pending, uuid, "Caller went away");
           },
-        });
+        }, new ByteLengthQueuingStrategy({ highWaterMark: 0 }));
       },
     );
 
@@ -151,22 +1110,66 @@ export class ProxyManager {
       method,
       path,
       body,
+      allowedDestinations: ALLOWED_DESTINATIONS.length > 0
+        ? ALLOWED_DESTINATIONS
+        : undefined,
+      reuse: {
+        keepAlive: options.keepAlive ?? UPSTREAM_KEEP_ALIVE,
+        idleTimeout: UPSTREAM_IDLE_TIMEOUT,
+      },
     };
-    this.socket!.send(JSON.stringify(requestMessage));
+    beginCapture(requestMessage, requestHeaders);
+    tailStart(uuid, method, path, clientId);
+    journalAccepted(uuid, method, path, clientId);
+    log.debug(`Dispatching ${uuid}: ${method} ${path}`);
+    await this.send(clientId, requestMessage);
+    const pending = this.pendingRequests.get(uuid);
+    if (
+      pending && ACK_TIMEOUT > 0 && this.negotiated.get(clientId)?.requestAcks
+    ) {
+      // Fail fast instead of waiting for headers from a client that never
+      // got the request.
+      pending.ackTimeout = setTimeout(
+        () => this.abortRequest(pending, uuid, "Request not acknowledged"),
+        ACK_TIMEOUT * 1000,
+      );
+    }
+    const sentAt = performance.now();
+    marks.sent = sentAt;
+    usage.requests++;
+    usage.bytesOut += bytesSent;
 
     try {
       // Wait for the headers to arrive.
       const { status, statusText, headers } = await headersPromise;
-      // Return a new response with the streaming body.
-      return new Response(responseStream!, { status, statusText, headers });
+      applyContentType(headers, options.contentType);
+      if (SERVER_TIMING) {
+        headers.set("server-timing", serverTiming(requestTimings(marks)));
+      }
+      usage.responses++;
+      usage.totalLatency += performance.now() - sentAt;
+      observeLatency(
+        this.identityOf(clientId),
+        (performance.now() - sentAt) / 1000,
+      );
+      // Return a new response with the streaming body. The client's reason
+      // phrase is kept, minus characters HTTP doesn't allow in it.
+      const responseBody = isBodiless(method, status) ? null : responseStream!;
+      return new Response(responseBody, {
+        status,
+        statusText: (statusText ?? "").replace(/[^\t\x20-\x7e\x80-\xff]/g, ""),
+        headers,
+      });
     } catch (error) {
-      console.error(`Proxy request ${uuid} failed:`, error);
+      log.error(`Proxy request ${uuid} failed:`, error);
+      usage.errors++;
+      notifyError(error, { source: "request", uuid, clientId, method, path });
       return new Response(
         error instanceof Error ? error.message : String(error),
         {
-          status: 504,
+          status: error instanceof ProxyError ? error.status : 504,
         },
-      ); // 504 Gateway Timeout
+      ); // 504 Gateway Timeout unless the error says otherwise
     }
   }
 }
@@ -0,0 +1,83 @@
+import { parseArgs } from "@std/cli/parse-args";
+import {
+  ClientResponse,
+  connectClient,
+  sendGoodbye,
+  sendResponse,
+} from "./client.ts";
+import { HOSTNAME, PASSWORD, PORT } from "./env.ts";
+
+// Headers describing the body as fetched; fetch has already decoded it, and
+// the server frames the response itself.
+const DROPPED_HEADERS = ["content-encoding", "content-length"];
+
+/**
+ * Connects as a proxy client that forwards every request to the `upstream`
+ * base URL and sends back its response. Bodies are buffered, and the
+ * fetched URL is reported so the server can enforce ALLOWED_DESTINATIONS.
+ * A pushed config may change the upstream (targetBaseUrl), the chunk size,
+ * whether each request is logged (logLevel "debug" or "info") or drain the
+ * client.
+ */
+export async function runProxyClient(args: string[]) {
+  const flags = parseArgs(args, {
+    string: ["target", "password", "upstream"],
+    default: { target: `http://${HOSTNAME}:${PORT}`, password: PASSWORD ?? "" },
+  });
+  if (!flags.upstream) {
+    console.error(
+      "Usage: main.ts client --upstream URL [--target URL] " +
+        "[--password PASSWORD]",
+    );
+    Deno.exit(1);
+  }
+
+  let upstream = flags.upstream;
+  let chunkSize: number | undefined;
+  let verbose = true;
+  const socket = await connectClient(
+    flags.target,
+    flags.password,
+    async (client, request) => {
+      const url = new URL(request.path, upstream);
+      let response: ClientResponse;
+      try {
+        // GET and HEAD requests can't have a body, not even an empty one.
+        const res = await fetch(url, {
+          method: request.method,
+          body: request.body || undefined,
+        });
+        const headers = Object.fromEntries(res.headers);
+        for (const name of DROPPED_HEADERS) delete headers[name];
+        response = {
+          status: res.status,
+          statusText: res.statusText,
+          headers,
+          body: new Uint8Array(await res.arrayBuffer()),
+          destination: url.href,
+        };
+      } catch (error) {
+        console.error(`${request.method} ${url} failed:`, error);
+        response = { status: 502, headers: {}, body: "Bad Gateway" };
+      }
+      if (verbose) {
+        console.log(`${request.method} ${request.path} -> ${response.status}`);
+      }
+      sendResponse(client, request.uuid, response, chunkSize);
+    },
+    (client, config) => {
+      if (config.targetBaseUrl) upstream = new URL(config.targetBaseUrl).href;
+      if (config.logLevel) {
+        verbose = config.logLevel === "debug" || config.logLevel === "info";
+      }
+      chunkSize = config.chunkSize ?? chunkSize;
+      if (config.drain) sendGoodbye(client, "Drain requested");
+    },
+  );
+  console.log(`Forwarding requests from ${flags.target} to ${upstream}.`);
+  // Drain instead of dropping in-flight requests on Ctrl-C.
+  Deno.addSignalListener("SIGINT", () => sendGoodbye(socket, "Interrupted"));
+
+  await new Promise((resolve) => socket.addEventListener("close", resolve));
+  console.log("Proxy client disconnected.");
+}
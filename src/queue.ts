@@ -0,0 +1,138 @@
+interface Waiter {
+  priority: number;
+  resolve: (admitted: boolean) => void;
+  deadline?: number;
+}
+
+/**
+ * What happens to a request that arrives when the queue is full:
+ * - "shed-lowest": the lowest-priority request, newest first among equals,
+ *   is shed, unless that would be the new request itself.
+ * - "reject-new": the new request is rejected.
+ * - "drop-oldest": the oldest queued request is dropped.
+ * - "block": the new request waits beyond the limit for up to the deadline.
+ */
+export const OVERFLOW_POLICIES = [
+  "shed-lowest",
+  "reject-new",
+  "drop-oldest",
+  "block",
+] as const;
+
+export type OverflowPolicy = typeof OVERFLOW_POLICIES[number];
+
+/**
+ * Limits how many requests are dispatched at once. Requests beyond the
+ * limit wait in a bounded queue and are admitted highest priority first,
+ * oldest first among equals.
+ */
+export class DispatchQueue {
+  private inFlight = 0;
+  private waiters: Waiter[] = [];
+  private shedCount = 0;
+
+  constructor(
+    private maxInFlight: number,
+    private maxQueued: number,
+    private policy: OverflowPolicy = "shed-lowest",
+    private deadline = 0, // Seconds a "block" request may wait
+  ) {}
+
+  get depth(): number {
+    return this.waiters.length;
+  }
+
+  get active(): number {
+    return this.inFlight;
+  }
+
+  /**
+   * Requests rejected or dropped because the queue was full.
+   */
+  get shed(): number {
+    return this.shedCount;
+  }
+
+  /**
+   * Resolves to true once the request may be dispatched, or to false if it
+   * was shed. Every admitted request must call release when done.
+   */
+  acquire(priority: number): Promise<boolean> {
+    if (this.maxInFlight <= 0 || this.inFlight < this.maxInFlight) {
+      this.inFlight++;
+      return Promise.resolve(true);
+    }
+
+    return new Promise((resolve) => {
+      const waiter: Waiter = { priority, resolve };
+      if (this.waiters.length >= this.maxQueued) {
+        const victim = this.overflow(waiter);
+        if (victim === waiter) {
+          this.shedCount++;
+          resolve(false);
+          return;
+        }
+        if (victim) this.drop(victim);
+      }
+      this.waiters.push(waiter);
+    });
+  }
+
+  release() {
+    const next = this.waiters.reduce<Waiter | undefined>(
+      (highest, waiter) =>
+        !highest || waiter.priority > highest.priority ? waiter : highest,
+      undefined,
+    );
+    if (!next) {
+      this.inFlight--;
+      return;
+    }
+    // Hand the slot straight to the next request.
+    this.waiters.splice(this.waiters.indexOf(next), 1);
+    clearTimeout(next.deadline);
+    next.resolve(true);
+  }
+
+  /**
+   * Picks the request to shed when `waiter` arrives at a full queue, or
+   * none if it may wait anyway.
+   */
+  private overflow(waiter: Waiter): Waiter | undefined {
+    if (this.waiters.length === 0 && this.policy !== "block") return waiter;
+
+    switch (this.policy) {
+      case "reject-new":
+        return waiter;
+
+      case "drop-oldest":
+        return this.waiters[0];
+
+      case "block":
+        if (this.deadline <= 0) return waiter;
+        waiter.deadline = setTimeout(() => {
+          const index = this.waiters.indexOf(waiter);
+          if (index === -1) return;
+          this.waiters.splice(index, 1);
+          this.shedCount++;
+          waiter.resolve(false);
+        }, this.deadline * 1000);
+        return undefined;
+
+      case "shed-lowest": {
+        const lowest = this.waiters.reduce(
+          (lowest, queued) =>
+            queued.priority <= lowest.priority ? queued : lowest,
+        );
+        return lowest.priority >= waiter.priority ? waiter : lowest;
+      }
+    }
+  }
+
+  private drop(waiter: Waiter) {
+    this.waiters.splice(this.waiters.indexOf(waiter), 1);
+    clearTimeout(waiter.deadline);
+    this.shedCount++;
+    waiter.resolve(false);
+  }
+}
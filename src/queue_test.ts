@@ -0,0 +1,93 @@
+import { assertEquals } from "@std/assert";
+import { DispatchQueue } from "./queue.ts";
+
+// Lets queued promises settle.
+const tick = () => new Promise((resolve) => setTimeout(resolve, 0));
+
+/**
+ * Tracks how a request's acquire settled: true, false, or undefined while
+ * it is still waiting.
+ */
+function track(admission: Promise<boolean>) {
+  const state: { admitted?: boolean } = {};
+  admission.then((admitted) => {
+    state.admitted = admitted;
+  });
+  return state;
+}
+
+Deno.test("DispatchQueue admits the highest priority next", async () => {
+  const queue = new DispatchQueue(1, 10);
+  assertEquals(await queue.acquire(0), true);
+  const low = track(queue.acquire(1));
+  const high = track(queue.acquire(5));
+  await tick();
+  assertEquals(queue.depth, 2);
+
+  queue.release();
+  await tick();
+  assertEquals([low.admitted, high.admitted], [undefined, true]);
+  queue.release();
+  await tick();
+  assertEquals(low.admitted, true);
+  assertEquals(queue.active, 1);
+});
+
+Deno.test("DispatchQueue sheds the lowest priority when full", async () => {
+  const queue = new DispatchQueue(1, 1);
+  await queue.acquire(0);
+  const low = track(queue.acquire(1));
+  const high = track(queue.acquire(5));
+  await tick();
+  assertEquals([low.admitted, high.admitted], [false, undefined]);
+  // A request no more important than the queued ones is shed itself.
+  assertEquals(await queue.acquire(5), false);
+  assertEquals(queue.shed, 2);
+  queue.release();
+  await tick();
+  assertEquals(high.admitted, true);
+});
+
+Deno.test("DispatchQueue with reject-new sheds the new request", async () => {
+  const queue = new DispatchQueue(1, 1, "reject-new");
+  await queue.acquire(0);
+  const queued = track(queue.acquire(0));
+  assertEquals(await queue.acquire(9), false);
+  assertEquals(queue.shed, 1);
+  queue.release();
+  await tick();
+  assertEquals(queued.admitted, true);
+});
+
+Deno.test("DispatchQueue with drop-oldest drops the oldest", async () => {
+  const queue = new DispatchQueue(1, 1, "drop-oldest");
+  await queue.acquire(0);
+  const oldest = track(queue.acquire(0));
+  const newest = track(queue.acquire(0));
+  await tick();
+  assertEquals([oldest.admitted, newest.admitted], [false, undefined]);
+  queue.release();
+  await tick();
+  assertEquals(newest.admitted, true);
+});
+
+Deno.test("DispatchQueue with block sheds after the deadline", async () => {
+  const queue = new DispatchQueue(1, 1, "block", 0.01);
+  await queue.acquire(0);
+  const queued = track(queue.acquire(0));
+  const blocked = track(queue.acquire(0));
+  await tick();
+  assertEquals(queue.depth, 2);
+  await new Promise((resolve) => setTimeout(resolve, 20));
+  assertEquals([queued.admitted, blocked.admitted], [undefined, false]);
+  assertEquals(queue.shed, 1);
+  queue.release();
+  await tick();
+  assertEquals(queued.admitted, true);
+});
+
+Deno.test("DispatchQueue without a limit admits everything", async () => {
+  const queue = new DispatchQueue(0, 0);
+  for (let i = 0; i < 5; i++) assertEquals(await queue.acquire(0), true);
+  assertEquals(queue.active, 5);
+});
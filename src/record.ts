@@ -0,0 +1,96 @@
+import { parseArgs } from "@std/cli/parse-args";
+import { redactHeaders } from "./capture.ts";
+import { HOSTNAME, PORT, RECORD_FILE } from "./env.ts";
+import { createLogger } from "./log.ts";
+
+const log = createLogger("record");
+
+export interface RecordedRequest {
+  time: number; // Milliseconds since the epoch
+  method: string;
+  path: string;
+  headers: Record<string, string>;
+  body?: string;
+}
+
+/**
+ * Appends a proxied request to RECORD_FILE, one JSON object per line, with
+ * the headers in REDACT_HEADERS redacted. A failed write is logged and
+ * doesn't fail the request.
+ */
+export async function recordRequest(
+  req: Request,
+  path: string,
+  body?: string,
+) {
+  if (!RECORD_FILE) return;
+
+  const entry: RecordedRequest = {
+    time: Date.now(),
+    method: req.method,
+    path,
+    headers: redactHeaders(req.headers),
+    body,
+  };
+  try {
+    await Deno.writeTextFile(RECORD_FILE, JSON.stringify(entry) + "\n", {
+      append: true,
+    });
+  } catch (error) {
+    log.error("Failed to record request:", error);
+  }
+}
+
+/**
+ * Replays a recording against a running server, keeping the original gaps
+ * between requests divided by `--speed`. A speed of 0 sends everything at
+ * once.
+ */
+export async function runReplay(args: string[]) {
+  const flags = parseArgs(args, {
+    string: ["target", "speed"],
+    default: { target: `http://${HOSTNAME}:${PORT}`, speed: "1" },
+  });
+  const file = flags._[0];
+  if (file === undefined) {
+    console.error("Usage: main.ts replay <file> [--target URL] [--speed N]");
+    Deno.exit(1);
+  }
+
+  const entries: RecordedRequest[] = (await Deno.readTextFile(String(file)))
+    .split("\n")
+    .filter((line) => line.trim())
+    .map((line) => JSON.parse(line));
+  if (entries.length === 0) return;
+
+  const speed = Number.parseFloat(flags.speed);
+  const start = performance.now();
+
+  await Promise.all(entries.map(async (entry) => {
+    if (speed > 0) {
+      const due = (entry.time - entries[0].time) / speed;
+      const wait = due - (performance.now() - start);
+      if (wait > 0) await new Promise((r) => setTimeout(r, wait));
+    }
+
+    const headers = new Headers(
+      Object.entries(entry.headers).filter(([, value]) =>
+        value !== "[REDACTED]"
+      ),
+    );
+    headers.delete("host");
+    headers.delete("content-length");
+
+    try {
+      const res = await fetch(new URL(entry.path, flags.target), {
+        method: entry.method,
+        headers,
+        body: entry.body,
+      });
+      await res.body?.cancel();
+      console.log(`${res.status} ${entry.method} ${entry.path}`);
+    } catch (error) {
+      console.error(`Replay of ${entry.method} ${entry.path} failed:`, error);
+    }
+  }));
+}
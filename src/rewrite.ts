@@ -0,0 +1,63 @@
+// Content types whose bodies have their URLs rewritten.
+const REWRITTEN_TYPES = ["text/html", "text/css"];
+
+/**
+ * Replaces every occurrence of the `from` origins in an HTML or CSS response
+ * with `to`, e.g. a backend's internal "http://app.internal:8080" with the
+ * proxy's public origin, so absolute links keep working behind the tunnel.
+ * Other responses, and compressed ones, are returned unchanged.
+ */
+export function rewriteUrls(
+  response: Response,
+  from: string[],
+  to: string,
+): Response {
+  const type = response.headers.get("content-type") ?? "";
+  if (
+    !response.body || from.length === 0 ||
+    response.headers.has("content-encoding") ||
+    !REWRITTEN_TYPES.some((rewritten) => type.startsWith(rewritten))
+  ) {
+    return response;
+  }
+
+  const pattern = new RegExp(
+    from.map((origin) => origin.replace(/[.*+?^${}()|[\]\\/]/g, "\\$&"))
+      .join("|"),
+    "g",
+  );
+  const longest = Math.max(...from.map((origin) => origin.length));
+
+  // Matches may straddle chunks, so the end of each chunk that could start
+  // one is held back until the next arrives.
+  let carry = "";
+  const rewriter = new TransformStream<string, string>({
+    transform(chunk, controller) {
+      const text = carry + chunk;
+      let result = "";
+      let last = 0;
+      for (const match of text.matchAll(pattern)) {
+        result += text.slice(last, match.index!) + to;
+        last = match.index! + match[0].length;
+      }
+      const keep = Math.max(last, text.length - (longest - 1));
+      carry = text.slice(keep);
+      controller.enqueue(result + text.slice(last, keep));
+    },
+    flush(controller) {
+      if (carry) controller.enqueue(carry);
+    },
+  });
+
+  const headers = new Headers(response.headers);
+  headers.delete("content-length");
+  const body = response.body
+    .pipeThrough(new TextDecoderStream())
+    .pipeThrough(rewriter)
+    .pipeThrough(new TextEncoderStream());
+  return new Response(body, {
+    status: response.status,
+    statusText: response.statusText,
+    headers,
+  });
+}
@@ -0,0 +1,182 @@
+import { ROUTES_FILE } from "./env.ts";
+
+/**
+ * Settings for requests whose path starts with `prefix` and, when `host` is
+ * set, that are for that host. Routes for the request's host take
+ * precedence over those for any host; among them, the one with the longest
+ * prefix applies.
+ */
+export interface Route {
+  prefix: string;
+  host?: string; // Matched against the request's hostname, any when unset
+  methods?: string[]; // Allowed methods, all when unset
+  headerTimeout?: number; // Seconds, overrides HEADER_TIMEOUT
+  totalTimeout?: number; // Seconds, overrides TOTAL_TIMEOUT
+  maxBodySize?: number; // Bytes, overrides MAX_BODY_SIZE
+  maxResponseSize?: number; // Bytes, overrides MAX_RESPONSE_SIZE
+  contentType?: string; // For responses the client sent without one
+  rewriteUrls?: string[]; // Backend origins replaced with the public one
+  wasmFilter?: string; // WebAssembly module filtering responses, see wasm.ts
+  priority?: number; // Overrides the X-Wsproxy-Priority header
+  keepAlive?: boolean; // Overrides UPSTREAM_KEEP_ALIVE
+}
+
+const isString = (value: unknown) => typeof value === "string";
+const isStringArray = (value: unknown) =>
+  Array.isArray(value) && value.every(isString);
+const isSeconds = (value: unknown) =>
+  typeof value === "number" && Number.isFinite(value) && value >= 0;
+const isBytes = (value: unknown) =>
+  Number.isSafeInteger(value) && (value as number) >= 0;
+
+const FIELDS: Record<keyof Route, [(value: unknown) => boolean, string]> = {
+  prefix: [isString, "a string"],
+  host: [isString, "a string"],
+  methods: [isStringArray, "an array of strings"],
+  headerTimeout: [isSeconds, "a non-negative number of seconds"],
+  totalTimeout: [isSeconds, "a non-negative number of seconds"],
+  maxBodySize: [isBytes, "a non-negative integer"],
+  maxResponseSize: [isBytes, "a non-negative integer"],
+  contentType: [isString, "a string"],
+  rewriteUrls: [isStringArray, "an array of strings"],
+  wasmFilter: [isString, "a string"],
+  priority: [Number.isSafeInteger, "an integer"],
+  keepAlive: [(value) => typeof value === "boolean", "a boolean"],
+};
+
+/**
+ * Checks that `value` is a route: an object with a string prefix and only
+ * known fields of the right types. Returns what is wrong, or null.
+ */
+export function routeError(value: unknown): string | null {
+  if (typeof value !== "object" || value === null || Array.isArray(value)) {
+    return "Route must be an object";
+  }
+  const route = value as Record<string, unknown>;
+  if (route.prefix === undefined) return "Missing route prefix";
+  for (const [name, field] of Object.entries(route)) {
+    if (!(name in FIELDS)) return `Unknown route field: ${name}`;
+    const [valid, expected] = FIELDS[name as keyof Route];
+    if (field !== undefined && !valid(field)) {
+      return `Route ${name} must be ${expected}`;
+    }
+  }
+  return null;
+}
+
+function normalize(route: Route): Route {
+  return {
+    ...route,
+    host: route.host?.toLowerCase(),
+    methods: route.methods?.map((method) => method.toUpperCase()),
+  };
+}
+
+function load(): Route[] {
+  if (!ROUTES_FILE) return [];
+  let routes: unknown;
+  try {
+    routes = JSON.parse(Deno.readTextFileSync(ROUTES_FILE));
+  } catch (error) {
+    if (error instanceof Deno.errors.NotFound) return [];
+    throw error;
+  }
+  if (!Array.isArray(routes)) {
+    throw new Error(`${ROUTES_FILE} must contain an array of routes`);
+  }
+  for (const route of routes) {
+    const error = routeError(route);
+    if (error) throw new Error(`${ROUTES_FILE}: ${error}`);
+  }
+  return (routes as Route[]).map(normalize);
+}
+
+/**
+ * Whether two routes are for the same prefix and host, so they can't both
+ * be in the table.
+ */
+function sameKey(a: Route, b: { prefix: string; host?: string }): boolean {
+  return a.prefix === b.prefix &&
+    (a.host ?? "") === (b.host?.toLowerCase() ?? "");
+}
+
+const routes = load();
+
+async function save() {
+  if (!ROUTES_FILE) return;
+  await Deno.writeTextFile(ROUTES_FILE, JSON.stringify(routes, null, 2));
+}
+
+/**
+ * Replaces the routes with those in ROUTES_FILE. Throws if it can't be
+ * read, keeping the current routes.
+ */
+export function reloadRoutes() {
+  routes.splice(0, routes.length, ...load());
+}
+
+export function listRoutes(): Route[] {
+  return routes;
+}
+
+/**
+ * Adds a route. Returns false if one with the same prefix and host exists.
+ */
+export async function addRoute(route: Route): Promise<boolean> {
+  if (routes.some((existing) => sameKey(existing, route))) return false;
+  routes.push(normalize(route));
+  await save();
+  return true;
+}
+
+/**
+ * Replaces the route with the same prefix and host. Returns false if there
+ * is none.
+ */
+export async function replaceRoute(route: Route): Promise<boolean> {
+  const index = routes.findIndex((existing) => sameKey(existing, route));
+  if (index === -1) return false;
+  routes[index] = normalize(route);
+  await save();
+  return true;
+}
+
+export async function deleteRoute(
+  prefix: string,
+  host?: string,
+): Promise<boolean> {
+  const index = routes.findIndex((route) => sameKey(route, { prefix, host }));
+  if (index === -1) return false;
+  routes.splice(index, 1);
+  await save();
+  return true;
+}
+
+/**
+ * Returns the route for a request to `host` and `pathname`, see Route.
+ */
+export function matchRoute(
+  host: string,
+  pathname: string,
+): Route | undefined {
+  host = host.toLowerCase();
+  let match: Route | undefined;
+  for (const route of routes) {
+    if (
+      !pathname.startsWith(route.prefix) ||
+      (route.host !== undefined && route.host !== host)
+    ) {
+      continue;
+    }
+    if (!match || moreSpecific(route, match)) match = route;
+  }
+  return match;
+}
+
+// Routes for a host beat those for any host, then longer prefixes win.
+function moreSpecific(a: Route, b: Route): boolean {
+  if ((a.host === undefined) !== (b.host === undefined)) {
+    return a.host !== undefined;
+  }
+  return a.prefix.length > b.prefix.length;
+}
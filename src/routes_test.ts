@@ -0,0 +1,49 @@
+import { assertEquals } from "@std/assert";
+import { addRoute, matchRoute, routeError } from "./routes.ts";
+
+Deno.test("routeError accepts valid routes", () => {
+  assertEquals(routeError({ prefix: "/api/" }), null);
+  assertEquals(
+    routeError({
+      prefix: "/api/",
+      host: "example.com",
+      methods: ["GET"],
+      headerTimeout: 1.5,
+      maxBodySize: 1024,
+      priority: -1,
+      keepAlive: false,
+    }),
+    null,
+  );
+});
+
+Deno.test("routeError rejects missing, unknown and mistyped fields", () => {
+  assertEquals(routeError(null), "Route must be an object");
+  assertEquals(routeError({ methods: ["GET"] }), "Missing route prefix");
+  assertEquals(
+    routeError({ prefix: "/", method: ["GET"] }),
+    "Unknown route field: method",
+  );
+  assertEquals(
+    routeError({ prefix: "/", methods: "GET" }),
+    "Route methods must be an array of strings",
+  );
+  assertEquals(
+    routeError({ prefix: "/", headerTimeout: "10" }),
+    "Route headerTimeout must be a non-negative number of seconds",
+  );
+  assertEquals(
+    routeError({ prefix: "/", maxBodySize: 1.5 }),
+    "Route maxBodySize must be a non-negative integer",
+  );
+});
+
+Deno.test("matchRoute prefers host routes, then longer prefixes", async () => {
+  await addRoute({ prefix: "/", priority: 1 });
+  await addRoute({ prefix: "/api/", priority: 2 });
+  await addRoute({ prefix: "/", host: "Admin.example.com", priority: 3 });
+
+  assertEquals(matchRoute("example.com", "/api/x")?.priority, 2);
+  assertEquals(matchRoute("example.com", "/x")?.priority, 1);
+  assertEquals(matchRoute("admin.example.com", "/api/x")?.priority, 3);
+});
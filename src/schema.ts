@@ -0,0 +1,190 @@
+/**
+ * JSON Schemas for the protocol messages in types.ts, for client authors
+ * validating their implementations. Keep in sync with types.ts.
+ */
+const capabilities = {
+  type: "object",
+  properties: {
+    binaryFrames: { type: "boolean" },
+    compression: { type: "boolean" },
+    requestStreaming: { type: "boolean" },
+    tunneling: { type: "boolean" },
+    requestAcks: { type: "boolean" },
+    maxChunkSize: { type: "integer" },
+  },
+};
+
+const base = (type: string) => ({
+  type: { const: type },
+  uuid: { type: "string", format: "uuid" },
+  signature: { type: "string" },
+  timestamp: { type: "integer" },
+  nonce: { type: "string" },
+});
+
+export const protocolSchema = {
+  $schema: "https://json-schema.org/draft/2020-12/schema",
+  $id: "ws_proxy/protocol",
+  oneOf: [
+    { $ref: "#/$defs/ProxyRequest" },
+    { $ref: "#/$defs/ProxyResponseHeaders" },
+    { $ref: "#/$defs/ProxyResponseChunk" },
+    { $ref: "#/$defs/ProxyCancel" },
+    { $ref: "#/$defs/ProxyRequestAck" },
+    { $ref: "#/$defs/ProxyFlushPools" },
+    { $ref: "#/$defs/ProxyProtocolError" },
+    { $ref: "#/$defs/ProxyConfig" },
+    { $ref: "#/$defs/ProxyConfigAck" },
+    { $ref: "#/$defs/ProxyHello" },
+    { $ref: "#/$defs/ProxyHelloAck" },
+    { $ref: "#/$defs/ProxyHeartbeat" },
+    { $ref: "#/$defs/ProxyGoodbye" },
+  ],
+  $defs: {
+    ProxyRequest: {
+      type: "object",
+      properties: {
+        ...base("request"),
+        method: { type: "string" },
+        path: { type: "string" },
+        body: { type: "string" },
+        allowedDestinations: { type: "array", items: { type: "string" } },
+        reuse: {
+          type: "object",
+          properties: {
+            keepAlive: { type: "boolean" },
+            idleTimeout: { type: "integer" },
+          },
+          required: ["keepAlive"],
+        },
+      },
+      required: ["type", "uuid", "method", "path"],
+    },
+    ProxyResponseHeaders: {
+      type: "object",
+      properties: {
+        ...base("response-headers"),
+        status: { type: "integer" },
+        statusText: { type: "string" },
+        headers: {
+          type: "object",
+          additionalProperties: { type: "string" },
+        },
+        destination: { type: "string" },
+      },
+      required: ["type", "uuid", "status", "statusText", "headers"],
+    },
+    ProxyResponseChunk: {
+      type: "object",
+      properties: {
+        ...base("response-chunk"),
+        data: { type: "string" },
+        encoding: { const: "base64" },
+        isFinal: { type: "boolean" },
+      },
+      required: ["type", "uuid", "data", "isFinal"],
+    },
+    ProxyCancel: {
+      type: "object",
+      properties: {
+        ...base("cancel"),
+        reason: { type: "string" },
+      },
+      required: ["type", "uuid"],
+    },
+    ProxyRequestAck: {
+      type: "object",
+      properties: base("request-ack"),
+      required: ["type", "uuid"],
+    },
+    ProxyFlushPools: {
+      type: "object",
+      properties: {
+        ...base("flush-pools"),
+        host: { type: "string" },
+      },
+      required: ["type", "uuid"],
+    },
+    ProxyProtocolError: {
+      type: "object",
+      properties: {
+        ...base("protocol-error"),
+        error: { type: "string" },
+        ref: { type: "string" },
+      },
+      required: ["type", "uuid", "error"],
+    },
+    ProxyConfig: {
+      type: "object",
+      properties: {
+        ...base("config"),
+        config: {
+          type: "object",
+          properties: {
+            chunkSize: { type: "integer" },
+            logLevel: { enum: ["debug", "info", "warn", "error"] },
+            targetBaseUrl: { type: "string" },
+            drain: { type: "boolean" },
+          },
+        },
+      },
+      required: ["type", "uuid", "config"],
+    },
+    ProxyConfigAck: {
+      type: "object",
+      properties: {
+        ...base("config-ack"),
+        ok: { type: "boolean" },
+        error: { type: "string" },
+      },
+      required: ["type", "uuid", "ok"],
+    },
+    ProxyHello: {
+      type: "object",
+      properties: {
+        ...base("hello"),
+        capabilities,
+        routes: {
+          type: "array",
+          items: {
+            type: "object",
+            properties: {
+              prefix: { type: "string" },
+              host: { type: "string" },
+            },
+            required: ["prefix"],
+          },
+        },
+      },
+      required: ["type", "uuid", "capabilities"],
+    },
+    ProxyHelloAck: {
+      type: "object",
+      properties: { ...base("hello-ack"), capabilities },
+      required: ["type", "uuid", "capabilities"],
+    },
+    ProxyHeartbeat: {
+      type: "object",
+      properties: {
+        ...base("heartbeat"),
+        health: {
+          type: "object",
+          properties: {
+            inFlight: { type: "integer" },
+            cpu: { type: "number" },
+            queueLength: { type: "integer" },
+          },
+        },
+      },
+      required: ["type", "uuid", "health"],
+    },
+    ProxyGoodbye: {
+      type: "object",
+      properties: {
+        ...base("goodbye"),
+        reason: { type: "string" },
+      },
+      required: ["type", "uuid"],
+    },
+  },
+};
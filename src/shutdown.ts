@@ -0,0 +1,69 @@
+import { PID_FILE, SHUTDOWN_TIMEOUT } from "./env.ts";
+import { createLogger } from "./log.ts";
+import { getDispatcher } from "./dispatcher.ts";
+import { reloadRoutes } from "./routes.ts";
+
+const log = createLogger("shutdown");
+
+let shuttingDown = false;
+
+/**
+ * Stops accepting connections, drains the proxy client and exits once
+ * in-flight requests are done, or after SHUTDOWN_TIMEOUT seconds. With
+ * REUSE_PORT, a new process listening on the same port takes over new
+ * connections, including the client's reconnect, in the meantime. A second
+ * call exits right away.
+ */
+async function shutdown(server: Deno.HttpServer) {
+  if (shuttingDown) exit(1);
+  shuttingDown = true;
+  log.info("Shutting down, draining in-flight requests.");
+
+  if (SHUTDOWN_TIMEOUT > 0) {
+    setTimeout(() => {
+      log.warn("Shutdown timed out, exiting.");
+      exit(1);
+    }, SHUTDOWN_TIMEOUT * 1000);
+  }
+  getDispatcher().drain();
+  await server.shutdown();
+  exit(0);
+}
+
+function exit(code: number): never {
+  if (PID_FILE) {
+    try {
+      Deno.removeSync(PID_FILE);
+    } catch {
+      // Already gone.
+    }
+  }
+  Deno.exit(code);
+}
+
+/**
+ * Reloads what can change without a restart: the routes from ROUTES_FILE.
+ */
+function reload() {
+  log.info("Reloading routes.");
+  try {
+    reloadRoutes();
+  } catch (error) {
+    log.error("Failed to reload routes, keeping the current ones:", error);
+  }
+}
+
+/**
+ * Writes PID_FILE and maps service manager signals onto the server: SIGTERM
+ * and SIGINT (Ctrl-C, also sent by Windows service wrappers) shut it down
+ * gracefully and SIGHUP reloads it.
+ */
+export function runAsService(server: Deno.HttpServer) {
+  if (PID_FILE) Deno.writeTextFileSync(PID_FILE, `${Deno.pid}\n`);
+
+  Deno.addSignalListener("SIGINT", () => shutdown(server));
+  // Windows has no SIGTERM or SIGHUP.
+  if (Deno.build.os === "windows") return;
+  Deno.addSignalListener("SIGTERM", () => shutdown(server));
+  Deno.addSignalListener("SIGHUP", reload);
+}
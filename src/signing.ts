@@ -0,0 +1,70 @@
+import { SIGN_MESSAGES } from "./env.ts";
+import { hmacSha256, timingSafeEqual } from "./hmac.ts";
+import { ProxyMessageUnion } from "./types.ts";
+
+/**
+ * Derives the key a client's messages are signed with from the credential
+ * it connected with (the password, a client token or a JWT), as
+ * HMAC-SHA256(secret, "ws_proxy message signing"), so the secret itself
+ * never keys message MACs directly.
+ */
+export function deriveSigningKey(secret: string): Promise<string> {
+  return hmacSha256(secret, "ws_proxy message signing");
+}
+
+/**
+ * The signed text: the UUID, type and the JSON of the message without its
+ * signature, separated by newlines.
+ */
+function canonical(message: ProxyMessageUnion): string {
+  const { signature: _, ...payload } = message;
+  return `${message.uuid}\n${message.type}\n${JSON.stringify(payload)}`;
+}
+
+/**
+ * Returns the message with a signature made with `key`.
+ */
+export async function signWithKey<T extends ProxyMessageUnion>(
+  message: T,
+  key: string,
+): Promise<T> {
+  const signature = await hmacSha256(key, canonical(message));
+  return { ...message, signature };
+}
+
+/**
+ * Checks that the message carries a valid signature made with `key`.
+ */
+export async function verifyWithKey(
+  message: ProxyMessageUnion,
+  key: string,
+): Promise<boolean> {
+  if (typeof message.signature !== "string") return false;
+  const expected = await hmacSha256(key, canonical(message));
+  return timingSafeEqual(expected, message.signature);
+}
+
+/**
+ * Adds a signature made with the client's key to the message when
+ * SIGN_MESSAGES is enabled.
+ */
+export async function signMessage<T extends ProxyMessageUnion>(
+  message: T,
+  key: Promise<string> | undefined,
+): Promise<T> {
+  if (!SIGN_MESSAGES || !key) return message;
+  return await signWithKey(message, await key);
+}
+
+/**
+ * Checks the signature of a message received from a client. Always passes
+ * when SIGN_MESSAGES is disabled, and fails when the client has no key.
+ */
+export async function verifyMessage(
+  message: ProxyMessageUnion,
+  key: Promise<string> | undefined,
+): Promise<boolean> {
+  if (!SIGN_MESSAGES) return true;
+  if (!key) return false;
+  return await verifyWithKey(message, await key);
+}
@@ -0,0 +1,41 @@
+import { assertEquals, assertNotEquals } from "@std/assert";
+import { deriveSigningKey, signWithKey, verifyWithKey } from "./signing.ts";
+import { ProxyResponseChunk } from "./types.ts";
+
+const message: ProxyResponseChunk = {
+  type: "response-chunk",
+  uuid: "0b4a6c1e-2f3d-4e5a-8b9c-0d1e2f3a4b5c",
+  data: "hello",
+  isFinal: true,
+};
+
+Deno.test("signWithKey signs messages verifyWithKey accepts", async () => {
+  const key = await deriveSigningKey("secret");
+  const signed = await signWithKey(message, key);
+  assertEquals(await verifyWithKey(signed, key), true);
+  // Signing is deterministic and covers the whole message.
+  assertEquals((await signWithKey(message, key)).signature, signed.signature);
+  assertNotEquals(
+    (await signWithKey({ ...message, data: "other" }, key)).signature,
+    signed.signature,
+  );
+});
+
+Deno.test("verifyWithKey rejects tampered and unsigned messages", async () => {
+  const key = await deriveSigningKey("secret");
+  const signed = await signWithKey(message, key);
+  assertEquals(await verifyWithKey({ ...signed, data: "other" }, key), false);
+  assertEquals(
+    await verifyWithKey(signed, await deriveSigningKey("other")),
+    false,
+  );
+  assertEquals(await verifyWithKey(message, key), false);
+});
+
+Deno.test("deriveSigningKey doesn't use the secret as the key", async () => {
+  assertNotEquals(await deriveSigningKey("secret"), "secret");
+  assertEquals(
+    await deriveSigningKey("secret"),
+    await deriveSigningKey("secret"),
+  );
+});
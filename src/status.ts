@@ -0,0 +1,29 @@
+import { parseArgs } from "@std/cli/parse-args";
+import { HOSTNAME, PASSWORD, PORT } from "./env.ts";
+import { ADMIN_PATH } from "./paths.ts";
+
+/**
+ * Prints the admin stats of a running server: whether a client is
+ * connected, pending and queued requests, memory and so on.
+ */
+export async function runStatus(args: string[]) {
+  const flags = parseArgs(args, {
+    string: ["target", "password"],
+    default: { target: `http://${HOSTNAME}:${PORT}`, password: PASSWORD ?? "" },
+  });
+
+  const url = new URL(`${ADMIN_PATH}/stats`, flags.target);
+  if (flags.password) url.searchParams.set("password", flags.password);
+  let response: Response;
+  try {
+    response = await fetch(url);
+  } catch (error) {
+    console.error(`Failed to reach ${flags.target}: ${error}`);
+    Deno.exit(1);
+  }
+  if (!response.ok) {
+    console.error(`${response.status} ${await response.text()}`);
+    Deno.exit(1);
+  }
+  console.log(JSON.stringify(await response.json(), null, 2));
+}
@@ -0,0 +1,128 @@
+import { RequestTimings } from "./timing.ts";
+
+/**
+ * A request as shown in the live tail.
+ */
+export interface TailEntry {
+  uuid: string;
+  method: string;
+  path: string;
+  clientId: string;
+  startedAt: string;
+  status?: number; // Once response headers arrived
+  duration?: number; // Milliseconds, once finished
+  outcome?: string; // "completed", "timed out", ...
+  timings?: RequestTimings; // Once finished
+}
+
+export interface TailFilter {
+  path?: string; // Path prefix
+  clientId?: string;
+}
+
+const RECENT_SIZE = 100;
+// Bytes of events buffered for a tail subscriber before it is disconnected.
+const STREAM_BUFFER = 1024 * 1024;
+
+const inFlight = new Map<string, { start: number; entry: TailEntry }>();
+const recent: TailEntry[] = [];
+const listeners = new Set<(entry: TailEntry) => void>();
+
+function matches(entry: TailEntry, filter: TailFilter): boolean {
+  return (!filter.path || entry.path.startsWith(filter.path)) &&
+    (!filter.clientId || entry.clientId === filter.clientId);
+}
+
+function publish(entry: TailEntry) {
+  for (const listener of listeners) listener(entry);
+}
+
+export function tailStart(
+  uuid: string,
+  method: string,
+  path: string,
+  clientId: string,
+) {
+  const entry = {
+    uuid,
+    method,
+    path,
+    clientId,
+    startedAt: new Date().toISOString(),
+  };
+  inFlight.set(uuid, { start: performance.now(), entry });
+  publish(entry);
+}
+
+export function tailHeaders(uuid: string, status: number) {
+  const request = inFlight.get(uuid);
+  if (!request) return;
+  request.entry.status = status;
+  publish(request.entry);
+}
+
+export function tailEnd(
+  uuid: string,
+  outcome: string,
+  timings: RequestTimings,
+) {
+  const request = inFlight.get(uuid);
+  if (!request) return;
+  inFlight.delete(uuid);
+
+  request.entry.duration = performance.now() - request.start;
+  request.entry.outcome = outcome;
+  request.entry.timings = timings;
+  recent.push(request.entry);
+  if (recent.length > RECENT_SIZE) recent.shift();
+  publish(request.entry);
+}
+
+/**
+ * Returns the requests in flight and the last finished ones.
+ */
+export function tailSnapshot(filter: TailFilter = {}) {
+  return {
+    inFlight: [...inFlight.values()]
+      .map(({ entry }) => entry)
+      .filter((entry) => matches(entry, filter)),
+    recent: recent.filter((entry) => matches(entry, filter)),
+  };
+}
+
+/**
+ * Streams request updates matching the filter as server-sent events, each
+ * carrying the request's current entry as JSON. Subscribers that fall more
+ * than STREAM_BUFFER bytes behind are disconnected, so a slow one can't
+ * grow memory without bound.
+ */
+export function tailStream(
+  filter: TailFilter = {},
+): ReadableStream<Uint8Array> {
+  const encoder = new TextEncoder();
+  let listener: (entry: TailEntry) => void;
+  let keepalive: number;
+  const stop = () => {
+    listeners.delete(listener);
+    clearInterval(keepalive);
+  };
+  return new ReadableStream<Uint8Array>({
+    start(controller) {
+      const send = (text: string) => {
+        if ((controller.desiredSize ?? 0) <= 0) {
+          stop();
+          controller.error(new Error("Tail subscriber too slow"));
+          return;
+        }
+        controller.enqueue(encoder.encode(text));
+      };
+      listener = (entry) => {
+        if (matches(entry, filter)) send(`data: ${JSON.stringify(entry)}\n\n`);
+      };
+      listeners.add(listener);
+      // Comments keep idle connections from being closed by proxies.
+      keepalive = setInterval(() => send(": keepalive\n\n"), 15000);
+    },
+    cancel: stop,
+  }, new ByteLengthQueuingStrategy({ highWaterMark: STREAM_BUFFER }));
+}
@@ -0,0 +1,45 @@
+/**
+ * Points in a request's life, from performance.now().
+ */
+export interface TimingMarks {
+  start: number; // The request reached the proxy manager
+  admitted?: number; // It got a dispatch slot
+  sent?: number; // It was sent to the client
+  headers?: number; // Response headers arrived
+  end?: number; // The response finished, one way or another
+}
+
+/**
+ * How long each phase of a request took, in milliseconds: waiting for a
+ * dispatch slot, signing and sending it, the tunnel and backend producing
+ * response headers, and streaming the body. Phases not reached are unset.
+ */
+export interface RequestTimings {
+  queue?: number;
+  dispatch?: number;
+  headers?: number;
+  streaming?: number;
+}
+
+const between = (from?: number, to?: number) =>
+  from === undefined || to === undefined ? undefined : to - from;
+
+export function requestTimings(marks: TimingMarks): RequestTimings {
+  return {
+    queue: between(marks.start, marks.admitted),
+    dispatch: between(marks.admitted, marks.sent),
+    headers: between(marks.sent, marks.headers),
+    streaming: between(marks.headers, marks.end),
+  };
+}
+
+/**
+ * Formats the phases known so far as a Server-Timing header value.
+ */
+export function serverTiming(timings: RequestTimings): string {
+  return Object.entries(timings)
+    .flatMap(([name, duration]) =>
+      duration === undefined ? [] : [`${name};dur=${duration.toFixed(1)}`]
+    )
+    .join(", ");
+}
@@ -0,0 +1,99 @@
+import { TOKENS_FILE } from "./env.ts";
+
+/**
+ * A credential for proxy clients, minted through the admin API. Only a hash
+ * of the secret is kept.
+ */
+interface ClientToken {
+  id: string;
+  label?: string;
+  hash: string; // Hex SHA-256 of the secret
+  createdAt: string;
+  expiresAt?: string;
+}
+
+const textEncoder = new TextEncoder();
+
+function load(): Map<string, ClientToken> {
+  if (!TOKENS_FILE) return new Map();
+  try {
+    const tokens: ClientToken[] = JSON.parse(
+      Deno.readTextFileSync(TOKENS_FILE),
+    );
+    return new Map(tokens.map((token) => [token.id, token]));
+  } catch (error) {
+    if (error instanceof Deno.errors.NotFound) return new Map();
+    throw error;
+  }
+}
+
+const tokens = load();
+
+async function save() {
+  if (!TOKENS_FILE) return;
+  await Deno.writeTextFile(
+    TOKENS_FILE,
+    JSON.stringify([...tokens.values()], null, 2),
+  );
+}
+
+async function sha256(text: string): Promise<string> {
+  const digest = await crypto.subtle.digest(
+    "SHA-256",
+    textEncoder.encode(text),
+  );
+  return Array.from(
+    new Uint8Array(digest),
+    (byte) => byte.toString(16).padStart(2, "0"),
+  ).join("");
+}
+
+export function listTokens() {
+  return [...tokens.values()].map(({ hash: _, ...token }) => token);
+}
+
+/**
+ * Creates a token, valid for `ttl` seconds if given. The secret is only
+ * returned here and cannot be retrieved later.
+ */
+export async function mintToken(label?: string, ttl?: number) {
+  const bytes = crypto.getRandomValues(new Uint8Array(32));
+  const secret = "wsp_" +
+    Array.from(bytes, (byte) => byte.toString(16).padStart(2, "0")).join("");
+
+  const token: ClientToken = {
+    id: crypto.randomUUID(),
+    label,
+    hash: await sha256(secret),
+    createdAt: new Date().toISOString(),
+    expiresAt: ttl
+      ? new Date(Date.now() + ttl * 1000).toISOString()
+      : undefined,
+  };
+  tokens.set(token.id, token);
+  await save();
+
+  const { hash: _, ...info } = token;
+  return { ...info, token: secret };
+}
+
+export async function revokeToken(id: string): Promise<boolean> {
+  if (!tokens.delete(id)) return false;
+  await save();
+  return true;
+}
+
+/**
+ * Returns the ID of the unexpired token matching `secret`, if any.
+ */
+export async function findToken(secret: string): Promise<string | undefined> {
+  const hash = await sha256(secret);
+  for (const token of tokens.values()) {
+    if (token.hash !== hash) continue;
+    if (token.expiresAt && Date.parse(token.expiresAt) <= Date.now()) {
+      return undefined;
+    }
+    return token.id;
+  }
+  return undefined;
+}
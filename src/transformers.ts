@@ -0,0 +1,62 @@
+import { createLogger } from "./log.ts";
+import { Route } from "./routes.ts";
+
+const log = createLogger("transformers");
+
+/**
+ * A streaming filter over response bodies, for embedders adding things like
+ * watermarks, secret scrubbing or analytics snippets.
+ */
+export interface BodyTransformer {
+  name: string;
+  /**
+   * Whether to transform this response, judging by e.g. its Content-Type
+   * and the route it was proxied for, if any.
+   */
+  matches(response: Response, route?: Route): boolean;
+  /**
+   * Returns the stream the body is piped through, once per response.
+   */
+  transform(
+    response: Response,
+    route?: Route,
+  ): TransformStream<Uint8Array, Uint8Array>;
+}
+
+const transformers: BodyTransformer[] = [];
+
+/**
+ * Adds a transformer. Matching transformers run in registration order.
+ */
+export function registerTransformer(transformer: BodyTransformer) {
+  transformers.push(transformer);
+}
+
+/**
+ * Pipes the response body through every matching transformer. The length
+ * of a transformed body is unknown, so its Content-Length is dropped.
+ */
+export function applyTransformers(response: Response, route?: Route): Response {
+  if (!response.body) return response;
+
+  let body = response.body;
+  let transformed = false;
+  for (const transformer of transformers) {
+    try {
+      if (!transformer.matches(response, route)) continue;
+      body = body.pipeThrough(transformer.transform(response, route));
+      transformed = true;
+    } catch (error) {
+      log.error(`Transformer ${transformer.name} failed:`, error);
+    }
+  }
+  if (!transformed) return response;
+
+  const headers = new Headers(response.headers);
+  headers.delete("content-length");
+  return new Response(body, {
+    status: response.status,
+    statusText: response.statusText,
+    headers,
+  });
+}
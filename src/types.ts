@@ -1,6 +1,9 @@
 interface ProxyMessageBase {
   type: string;
   uuid: string;
+  signature?: string; // HMAC when message signing is enabled
+  timestamp?: number; // Milliseconds since the epoch, for replay protection
+  nonce?: string; // Unique per message, for replay protection
 }
 
 export interface ProxyRequest extends ProxyMessageBase {
@@ -9,6 +12,17 @@ export interface ProxyRequest extends ProxyMessageBase {
   method: string;
   path: string; // Full path, including query parameters
   body?: string;
+  allowedDestinations?: string[]; // Upstream hosts the client may fetch
+  reuse?: ConnectionReuse;
+}
+
+/**
+ * Hints for how the client should treat its upstream connection, so it can
+ * pool connections per host.
+ */
+export interface ConnectionReuse {
+  keepAlive: boolean; // Whether to keep the connection open afterwards
+  idleTimeout?: number; // Seconds an idle pooled connection is worth keeping
 }
 
 export interface ProxyResponseHeaders extends ProxyMessageBase {
@@ -17,18 +31,169 @@ export interface ProxyResponseHeaders extends ProxyMessageBase {
   status: number;
   statusText: string;
   headers: Record<string, string>;
+  destination?: string; // URL the client fetched, checked against policy
 }
 
 export interface ProxyResponseChunk extends ProxyMessageBase {
   type: "response-chunk";
 
   data: string;
+  encoding?: "base64"; // Set for binary data, which is otherwise UTF-8 text
   isFinal: boolean;
 }
 
+/**
+ * Tells the client to stop working on a request, e.g. because the caller
+ * went away or the response grew too large. Further messages for it are
+ * ignored.
+ */
+export interface ProxyCancel extends ProxyMessageBase {
+  type: "cancel";
+
+  reason?: string;
+}
+
+/**
+ * Tells the client to close its pooled upstream connections, to all hosts
+ * or only to `host`, e.g. after a backend was redeployed.
+ */
+export interface ProxyFlushPools extends ProxyMessageBase {
+  type: "flush-pools";
+
+  host?: string;
+}
+
+/**
+ * Sent by a client as soon as it receives a request, when requestAcks was
+ * negotiated.
+ */
+export interface ProxyRequestAck extends ProxyMessageBase {
+  type: "request-ack";
+}
+
+/**
+ * Sent to a client that sent a malformed message, saying what was wrong.
+ */
+export interface ProxyProtocolError extends ProxyMessageBase {
+  type: "protocol-error";
+
+  error: string;
+  ref?: string; // UUID of the offending message, if it had a valid one
+}
+
+/**
+ * Optional protocol features, advertised by both sides in the handshake.
+ */
+export interface Capabilities {
+  binaryFrames?: boolean;
+  compression?: boolean;
+  requestStreaming?: boolean;
+  tunneling?: boolean;
+  requestAcks?: boolean; // The client acks every request it receives
+  maxChunkSize?: number; // Characters per response chunk
+}
+
+/**
+ * Requests a client says it serves: paths starting with `prefix`, and only
+ * for `host` when set.
+ */
+export interface AnnouncedRoute {
+  prefix: string;
+  host?: string;
+}
+
+/**
+ * Sent by a client right after connecting to declare what it supports and,
+ * optionally, which requests it serves.
+ */
+export interface ProxyHello extends ProxyMessageBase {
+  type: "hello";
+
+  capabilities: Capabilities;
+  routes?: AnnouncedRoute[];
+}
+
+/**
+ * The server's answer to a hello: the features both sides support, which
+ * are the only ones either side may use.
+ */
+export interface ProxyHelloAck extends ProxyMessageBase {
+  type: "hello-ack";
+
+  capabilities: Capabilities;
+}
+
+/**
+ * Settings the server can push to a client at runtime.
+ */
+export interface ClientConfig {
+  chunkSize?: number; // Characters, or bytes, per response chunk
+  logLevel?: "debug" | "info" | "warn" | "error";
+  targetBaseUrl?: string; // Base URL request paths are resolved against
+  drain?: boolean; // Finish in-flight requests, then say goodbye
+}
+
+/**
+ * Pushes new settings to a client, which answers with a config-ack.
+ */
+export interface ProxyConfig extends ProxyMessageBase {
+  type: "config";
+
+  config: ClientConfig;
+}
+
+/**
+ * A client's answer to a config message, with the same UUID. Clients that
+ * can't apply a setting reject the whole change with an error.
+ */
+export interface ProxyConfigAck extends ProxyMessageBase {
+  type: "config-ack";
+
+  ok: boolean;
+  error?: string;
+}
+
+/**
+ * Load reported by a client in its heartbeats.
+ */
+export interface ClientHealth {
+  inFlight?: number; // Upstream requests in progress
+  cpu?: number; // Load hint between 0 and 1
+  queueLength?: number; // Requests waiting on the client side
+}
+
+/**
+ * Sent periodically by a client to report its load.
+ */
+export interface ProxyHeartbeat extends ProxyMessageBase {
+  type: "heartbeat";
+
+  health: ClientHealth;
+}
+
+/**
+ * Sent by a client about to shut down. The server stops dispatching to it
+ * and closes the connection once its in-flight responses are done.
+ */
+export interface ProxyGoodbye extends ProxyMessageBase {
+  type: "goodbye";
+
+  reason?: string;
+}
+
 export type ProxyMessageUnion =
   | ProxyRequest
   | ProxyResponseHeaders
-  | ProxyResponseChunk;
+  | ProxyResponseChunk
+  | ProxyCancel
+  | ProxyRequestAck
+  | ProxyFlushPools
+  | ProxyProtocolError
+  | ProxyConfig
+  | ProxyConfigAck
+  | ProxyHello
+  | ProxyHelloAck
+  | ProxyHeartbeat
+  | ProxyGoodbye;
 
 export type ProxyMessageType = ProxyMessageUnion["type"];
@@ -0,0 +1,129 @@
+import { USAGE_DUMP_FILE, USAGE_DUMP_INTERVAL } from "./env.ts";
+import { createLogger } from "./log.ts";
+
+const log = createLogger("usage");
+
+/**
+ * Usage counters of a proxy client identity: the password, a client token
+ * or an OpenID Connect subject. They carry over when it reconnects.
+ */
+export interface ClientUsage {
+  identity: string; // "password", "anonymous", "token:<id>" or "oidc:<sub>"
+  clientId: string; // Its latest connection
+  connectedAt: string;
+  disconnectedAt?: string;
+  requests: number; // Requests dispatched to the client
+  responses: number; // Requests that received response headers
+  errors: number; // Requests that timed out or were dropped
+  bytesIn: number; // Response body bytes received from the client
+  bytesOut: number; // Request body bytes sent to the client
+  totalLatency: number; // Milliseconds until response headers, summed
+}
+
+// Counters of at most this many disconnected identities are kept; the ones
+// that disconnected longest ago are forgotten first.
+const MAX_DISCONNECTED = 100;
+
+const usage = new Map<string, ClientUsage>();
+
+/**
+ * Returns the counters for an identity, creating them on first use.
+ */
+export function usageFor(identity: string): ClientUsage {
+  let entry = usage.get(identity);
+  if (!entry) {
+    entry = {
+      identity,
+      clientId: "",
+      connectedAt: new Date().toISOString(),
+      requests: 0,
+      responses: 0,
+      errors: 0,
+      bytesIn: 0,
+      bytesOut: 0,
+      totalLatency: 0,
+    };
+    usage.set(identity, entry);
+  }
+  return entry;
+}
+
+export function usageConnected(identity: string, clientId: string) {
+  const entry = usageFor(identity);
+  entry.clientId = clientId;
+  entry.connectedAt = new Date().toISOString();
+  delete entry.disconnectedAt;
+}
+
+export function usageDisconnected(identity: string, clientId: string) {
+  const entry = usage.get(identity);
+  // The identity may have reconnected already.
+  if (entry?.clientId !== clientId) return;
+  entry.disconnectedAt = new Date().toISOString();
+
+  const disconnected = [...usage.values()]
+    .filter((entry) => entry.disconnectedAt)
+    .sort((a, b) => a.disconnectedAt!.localeCompare(b.disconnectedAt!));
+  for (const entry of disconnected.slice(0, -MAX_DISCONNECTED)) {
+    usage.delete(entry.identity);
+  }
+}
+
+export function usageReport() {
+  return [...usage.values()].map(({ totalLatency, ...entry }) => ({
+    ...entry,
+    averageLatency: entry.responses ? totalLatency / entry.responses : 0,
+  }));
+}
+
+const CSV_COLUMNS = [
+  "identity",
+  "clientId",
+  "connectedAt",
+  "disconnectedAt",
+  "requests",
+  "responses",
+  "errors",
+  "bytesIn",
+  "bytesOut",
+  "averageLatency",
+] as const;
+
+export function usageCsv(): string {
+  const rows = usageReport().map((entry) =>
+    CSV_COLUMNS.map((column) => entry[column] ?? "").join(",")
+  );
+  return [CSV_COLUMNS.join(","), ...rows].join("\n") + "\n";
+}
+
+/**
+ * Zeroes the counters of connected identities and forgets disconnected ones.
+ */
+export function resetUsage() {
+  for (const [identity, entry] of usage) {
+    if (entry.disconnectedAt) {
+      usage.delete(identity);
+      continue;
+    }
+    entry.requests = entry.responses = entry.errors = 0;
+    entry.bytesIn = entry.bytesOut = entry.totalLatency = 0;
+  }
+}
+
+/**
+ * Periodically writes the usage report to USAGE_DUMP_FILE, as CSV if the
+ * file name ends in .csv and as JSON otherwise.
+ */
+export function startUsageDump() {
+  if (!USAGE_DUMP_FILE) return;
+
+  const file = USAGE_DUMP_FILE;
+  setInterval(() => {
+    const content = file.endsWith(".csv")
+      ? usageCsv()
+      : JSON.stringify(usageReport(), null, 2);
+    Deno.writeTextFile(file, content).catch((error) =>
+      log.error("Failed to write usage dump:", error)
+    );
+  }, USAGE_DUMP_INTERVAL * 1000);
+}
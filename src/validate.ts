@@ -0,0 +1,134 @@
+import {
+  MAX_HEADER_SIZE,
+  MAX_MESSAGE_SIZE,
+  MAX_RESPONSE_HEADERS,
+} from "./env.ts";
+import { ProxyMessageUnion } from "./types.ts";
+
+const UUID_PATTERN =
+  /^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$/i;
+
+export function isUuid(value: unknown): value is string {
+  return typeof value === "string" && UUID_PATTERN.test(value);
+}
+
+type FieldType = "string" | "number" | "boolean" | "object";
+
+// Required fields of the messages clients may send, by type.
+const REQUIRED_FIELDS: Record<string, Record<string, FieldType>> = {
+  "response-headers": { status: "number", headers: "object" },
+  "response-chunk": { data: "string", isFinal: "boolean" },
+  "request-ack": {},
+  "config-ack": { ok: "boolean" },
+  "hello": { capabilities: "object" },
+  "heartbeat": { health: "object" },
+  "goodbye": {},
+};
+
+function typeOf(value: unknown): string {
+  if (value === null) return "null";
+  if (Array.isArray(value)) return "array";
+  return typeof value;
+}
+
+/**
+ * Checks that a parsed message from a client is one clients may send, with
+ * a valid UUID and its required fields. Returns what is wrong with it, if
+ * anything.
+ */
+export function validateMessage(message: unknown): string | undefined {
+  if (typeOf(message) !== "object") return "Message is not an object";
+  const fields = message as Record<string, unknown>;
+  const { type } = fields;
+  if (typeof type !== "string" || !Object.hasOwn(REQUIRED_FIELDS, type)) {
+    return `Unknown message type: ${type}`;
+  }
+  if (!isUuid(fields.uuid)) return `Invalid UUID in ${type}`;
+  for (const [field, expected] of Object.entries(REQUIRED_FIELDS[type])) {
+    if (typeOf(fields[field]) !== expected) {
+      return `Field ${field} of ${type} must be of type ${expected}`;
+    }
+  }
+}
+
+/**
+ * Bounds on what clients may send. 0 means no limit.
+ */
+export interface ParseLimits {
+  maxMessageSize: number; // Characters of a whole message
+  maxHeaders: number; // Headers in a response-headers message
+  maxHeaderSize: number; // Characters of a header name plus its value
+}
+
+const DEFAULT_LIMITS: ParseLimits = {
+  maxMessageSize: MAX_MESSAGE_SIZE,
+  maxHeaders: MAX_RESPONSE_HEADERS,
+  maxHeaderSize: MAX_HEADER_SIZE,
+};
+
+export type ParseResult =
+  | { message: ProxyMessageUnion; error?: undefined }
+  | { message?: undefined; error: string; uuid?: string };
+
+/**
+ * Turns a text message from a client into a protocol message, or says what
+ * is wrong with it, along with its UUID if it had a valid one. It has no
+ * side effects, so it can be fuzzed on its own.
+ */
+export function parseMessage(
+  data: string,
+  limits: ParseLimits = DEFAULT_LIMITS,
+): ParseResult {
+  if (limits.maxMessageSize > 0 && data.length > limits.maxMessageSize) {
+    return { error: `Message larger than ${limits.maxMessageSize} characters` };
+  }
+
+  let parsed: unknown;
+  try {
+    parsed = JSON.parse(data);
+  } catch {
+    return { error: "Message is not valid JSON" };
+  }
+  const uuid = (parsed as { uuid?: unknown } | null)?.uuid;
+  const fail = (error: string): ParseResult => ({
+    error,
+    uuid: isUuid(uuid) ? uuid : undefined,
+  });
+
+  const problem = validateMessage(parsed);
+  if (problem) return fail(problem);
+
+  const message = parsed as ProxyMessageUnion;
+  if (message.type === "hello" && message.routes !== undefined) {
+    if (!Array.isArray(message.routes)) {
+      return fail("Field routes of hello must be an array");
+    }
+    for (const route of message.routes as unknown[]) {
+      const { prefix, host } = (route ?? {}) as Record<string, unknown>;
+      if (
+        typeOf(route) !== "object" || typeof prefix !== "string" ||
+        (host !== undefined && typeof host !== "string")
+      ) {
+        return fail("Routes in hello must have a string prefix and host");
+      }
+    }
+  }
+  if (message.type === "response-headers") {
+    const headers = Object.entries(message.headers);
+    if (limits.maxHeaders > 0 && headers.length > limits.maxHeaders) {
+      return fail(`More than ${limits.maxHeaders} response headers`);
+    }
+    for (const [name, value] of headers) {
+      if (typeof value !== "string") {
+        return fail(`Header ${name} must be a string`);
+      }
+      if (
+        limits.maxHeaderSize > 0 &&
+        name.length + value.length > limits.maxHeaderSize
+      ) {
+        return fail(`Header ${name} longer than ${limits.maxHeaderSize}`);
+      }
+    }
+  }
+  return { message };
+}
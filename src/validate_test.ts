@@ -0,0 +1,137 @@
+import { assertEquals } from "@std/assert";
+import {
+  isUuid,
+  ParseLimits,
+  parseMessage,
+  validateMessage,
+} from "./validate.ts";
+
+const UUID = "0b4a6c1e-2f3d-4e5a-8b9c-0d1e2f3a4b5c";
+const LIMITS: ParseLimits = {
+  maxMessageSize: 1000,
+  maxHeaders: 2,
+  maxHeaderSize: 20,
+};
+
+const parse = (message: unknown) =>
+  parseMessage(JSON.stringify(message), LIMITS);
+
+Deno.test("isUuid accepts only UUIDs", () => {
+  assertEquals(isUuid(UUID), true);
+  assertEquals(isUuid(UUID.toUpperCase()), true);
+  assertEquals(isUuid(UUID.slice(1)), false);
+  assertEquals(isUuid(42), false);
+});
+
+Deno.test("validateMessage accepts messages clients may send", () => {
+  assertEquals(
+    validateMessage({
+      type: "response-headers",
+      uuid: UUID,
+      status: 200,
+      headers: {},
+    }),
+    undefined,
+  );
+  assertEquals(validateMessage({ type: "goodbye", uuid: UUID }), undefined);
+});
+
+Deno.test("validateMessage says what is wrong with a message", () => {
+  assertEquals(validateMessage([]), "Message is not an object");
+  assertEquals(validateMessage(null), "Message is not an object");
+  // Only the server sends requests.
+  assertEquals(
+    validateMessage({ type: "request", uuid: UUID }),
+    "Unknown message type: request",
+  );
+  assertEquals(
+    validateMessage({ type: "goodbye", uuid: "nope" }),
+    "Invalid UUID in goodbye",
+  );
+  assertEquals(
+    validateMessage({
+      type: "response-chunk",
+      uuid: UUID,
+      data: "",
+      isFinal: "yes",
+    }),
+    "Field isFinal of response-chunk must be of type boolean",
+  );
+});
+
+Deno.test("parseMessage returns valid messages", () => {
+  const message = {
+    type: "response-headers",
+    uuid: UUID,
+    status: 200,
+    headers: { "content-type": "text/plain" },
+  };
+  assertEquals(parse(message), { message });
+});
+
+Deno.test("parseMessage rejects oversized and invalid JSON", () => {
+  assertEquals(
+    parseMessage("x".repeat(1001), LIMITS).error,
+    "Message larger than 1000 characters",
+  );
+  assertEquals(parseMessage("{", LIMITS).error, "Message is not valid JSON");
+});
+
+Deno.test("parseMessage keeps the UUID of invalid messages", () => {
+  assertEquals(
+    parse({ type: "response-chunk", uuid: UUID, data: "", isFinal: "yes" }),
+    {
+      error: "Field isFinal of response-chunk must be of type boolean",
+      uuid: UUID,
+    },
+  );
+  assertEquals(parse({ type: "goodbye", uuid: "nope" }).uuid, undefined);
+});
+
+Deno.test("parseMessage enforces header limits", () => {
+  const headers = (headers: Record<string, unknown>) =>
+    parse({ type: "response-headers", uuid: UUID, status: 200, headers });
+  assertEquals(
+    headers({ a: "1", b: "2", c: "3" }).error,
+    "More than 2 response headers",
+  );
+  assertEquals(headers({ a: 1 }).error, "Header a must be a string");
+  assertEquals(
+    headers({ a: "x".repeat(20) }).error,
+    "Header a longer than 20",
+  );
+});
+
+Deno.test("parseMessage without limits accepts large messages", () => {
+  const limits = { maxMessageSize: 0, maxHeaders: 0, maxHeaderSize: 0 };
+  const headers = Object.fromEntries(
+    Array.from({ length: 200 }, (_, i) => [`h${i}`, "x".repeat(100)]),
+  );
+  const message = {
+    type: "response-headers",
+    uuid: UUID,
+    status: 200,
+    headers,
+  };
+  assertEquals(parseMessage(JSON.stringify(message), limits).error, undefined);
+});
+
+Deno.test("parseMessage validates announced routes", () => {
+  const hello = (routes: unknown) =>
+    parse({ type: "hello", uuid: UUID, capabilities: {}, routes });
+  assertEquals(
+    hello([{ prefix: "/api/", host: "a.example" }]).error,
+    undefined,
+  );
+  assertEquals(
+    hello({ prefix: "/" }).error,
+    "Field routes of hello must be an array",
+  );
+  const invalid = [null, "/api/", { host: "a" }, { prefix: "/", host: 1 }];
+  for (const route of invalid) {
+    assertEquals(
+      hello([route]).error,
+      "Routes in hello must have a string prefix and host",
+    );
+  }
+});
@@ -0,0 +1,123 @@
+import { WASM_FILTER_DIR, WASM_FILTER_TIMEOUT } from "./env.ts";
+import { createLogger } from "./log.ts";
+import { Route } from "./routes.ts";
+import { BodyTransformer } from "./transformers.ts";
+import type { WorkerRequest, WorkerResponse } from "./wasm_worker.ts";
+
+const log = createLogger("wasm");
+
+const SEPARATOR = Deno.build.os === "windows" ? "\\" : "/";
+
+/**
+ * Resolves a route's `wasmFilter`, a path relative to WASM_FILTER_DIR.
+ * Returns null if no directory is set or the path could leave it.
+ */
+export function filterPath(name: string): string | null {
+  if (!WASM_FILTER_DIR) return null;
+  const segments = name.split(/[\\/]/);
+  if (
+    name.includes(":") ||
+    segments.some((segment) => segment === "" || segment === "..")
+  ) {
+    return null;
+  }
+  return `${WASM_FILTER_DIR.replace(/[\\/]$/, "")}${SEPARATOR}${name}`;
+}
+
+const modules = new Map<string, Promise<Uint8Array>>();
+
+function loadModule(name: string): Promise<Uint8Array> {
+  let module = modules.get(name);
+  if (!module) {
+    module = (async () => {
+      const path = filterPath(name);
+      if (!path) throw new Error(`${name} is not inside WASM_FILTER_DIR`);
+      // Symlinks must not lead out of the directory either.
+      const [real, dir] = await Promise.all([
+        Deno.realPath(path),
+        Deno.realPath(WASM_FILTER_DIR!),
+      ]);
+      if (!real.startsWith(dir + SEPARATOR)) {
+        throw new Error(`${name} is not inside WASM_FILTER_DIR`);
+      }
+      return await Deno.readFile(real);
+    })();
+    modules.set(name, module);
+  }
+  return module;
+}
+
+/**
+ * A filter instance running in its own worker. Each call must be answered
+ * within WASM_FILTER_TIMEOUT seconds, or the worker is terminated.
+ */
+class FilterWorker {
+  private worker = new Worker(new URL("./wasm_worker.ts", import.meta.url), {
+    type: "module",
+  });
+
+  call(request: WorkerRequest): Promise<Uint8Array | undefined> {
+    return new Promise((resolve, reject) => {
+      const fail = (error: Error) => {
+        clearTimeout(timer);
+        this.terminate();
+        reject(error);
+      };
+      const timer = setTimeout(
+        () => fail(new Error("Timed out")),
+        WASM_FILTER_TIMEOUT * 1000,
+      );
+      this.worker.onmessage = ({ data }: MessageEvent<WorkerResponse>) => {
+        if (data.error !== undefined) return fail(new Error(data.error));
+        clearTimeout(timer);
+        resolve(data.chunk);
+      };
+      this.worker.onerror = (event) => {
+        event.preventDefault();
+        fail(new Error(event.message));
+      };
+      this.worker.postMessage(request);
+    });
+  }
+
+  terminate() {
+    this.worker.terminate();
+  }
+}
+
+/**
+ * Runs response bodies of routes with a `wasmFilter` through that module,
+ * one chunk at a time. Each response gets a fresh instance in a worker; a
+ * trap or a chunk taking too long aborts the response.
+ */
+export const wasmTransformer: BodyTransformer = {
+  name: "wasm",
+
+  matches: (_response: Response, route?: Route) => !!route?.wasmFilter,
+
+  transform(_response: Response, route?: Route) {
+    const name = route!.wasmFilter!;
+    const worker = new FilterWorker();
+    return new TransformStream<Uint8Array, Uint8Array>({
+      async start() {
+        try {
+          await worker.call({ type: "load", bytes: await loadModule(name) });
+        } catch (error) {
+          log.error(`Failed to load WASM filter ${name}:`, error);
+          worker.terminate();
+          throw error;
+        }
+      },
+      async transform(chunk, controller) {
+        try {
+          controller.enqueue((await worker.call({ type: "chunk", chunk }))!);
+        } catch (error) {
+          log.error(`WASM filter ${name} failed, aborting response:`, error);
+          throw error;
+        }
+      },
+      flush: () => worker.terminate(),
+      cancel: () => worker.terminate(),
+    });
+  },
+};
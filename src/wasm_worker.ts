@@ -0,0 +1,59 @@
+/// <reference no-default-lib="true" />
+/// <reference lib="deno.worker" />
+
+/**
+ * Runs a WASM response filter for wasm.ts off the main thread, so a trap or
+ * a runaway loop in it can't stall the server. The main thread first sends
+ * the module's bytes, then one chunk at a time, and waits for each reply.
+ */
+
+export type WorkerRequest =
+  | { type: "load"; bytes: Uint8Array }
+  | { type: "chunk"; chunk: Uint8Array };
+
+export interface WorkerResponse {
+  chunk?: Uint8Array;
+  error?: string;
+}
+
+/**
+ * The exports a filter module must provide. The module gets no imports, so
+ * it can only see the bytes it is given.
+ */
+interface FilterExports {
+  memory: WebAssembly.Memory;
+  // Returns a pointer to `size` free bytes in memory.
+  alloc(size: number): number;
+  // Filters the chunk at `ptr`, returning the output's pointer in the high
+  // 32 bits and its length in the low 32 bits.
+  filter(ptr: number, length: number): bigint;
+}
+
+let filter: FilterExports;
+
+self.onmessage = async ({ data }: MessageEvent<WorkerRequest>) => {
+  try {
+    if (data.type === "load") {
+      const { instance } = await WebAssembly.instantiate(data.bytes, {});
+      filter = instance.exports as unknown as FilterExports;
+      self.postMessage({} satisfies WorkerResponse);
+      return;
+    }
+
+    const { chunk } = data;
+    const input = filter.alloc(chunk.byteLength);
+    new Uint8Array(filter.memory.buffer, input, chunk.byteLength).set(chunk);
+    const result = filter.filter(input, chunk.byteLength);
+    const output = Number(result >> 32n);
+    const length = Number(result & 0xffffffffn);
+    // Copy out, as the module may reuse its memory for the next chunk.
+    const filtered = new Uint8Array(filter.memory.buffer, output, length)
+      .slice();
+    self.postMessage(
+      { chunk: filtered } satisfies WorkerResponse,
+      [filtered.buffer],
+    );
+  } catch (error) {
+    self.postMessage({ error: String(error) } satisfies WorkerResponse);
+  }
+};
@@ -0,0 +1,39 @@
+import { WEBHOOK_SECRET, WEBHOOK_URLS } from "./env.ts";
+import { hmacSha256 } from "./hmac.ts";
+import { createLogger } from "./log.ts";
+
+const log = createLogger("webhooks");
+
+export interface ClientEvent {
+  event: "connected" | "disconnected";
+  clientId: string;
+  identity: string; // Who the client authenticated as, see ProxyManager.accept
+  requestId?: string; // X-Request-Id of the upgrade request, if it had one
+  reason?: string;
+}
+
+/**
+ * POSTs a client event to every WEBHOOK_URLS entry. When WEBHOOK_SECRET is
+ * set, the body is signed in the X-Wsproxy-Signature header as
+ * "sha256=<hex HMAC>". Failures are logged and otherwise ignored.
+ */
+export async function notifyWebhooks(event: ClientEvent) {
+  if (WEBHOOK_URLS.length === 0) return;
+
+  const body = JSON.stringify({ ...event, time: new Date().toISOString() });
+  const headers = new Headers({ "content-type": "application/json" });
+  if (WEBHOOK_SECRET) {
+    const signature = await hmacSha256(WEBHOOK_SECRET, body);
+    headers.set("x-wsproxy-signature", `sha256=${signature}`);
+  }
+
+  await Promise.all(WEBHOOK_URLS.map(async (url) => {
+    try {
+      const res = await fetch(url, { method: "POST", headers, body });
+      await res.body?.cancel();
+      if (!res.ok) log.warn(`Webhook ${url} returned ${res.status}`);
+    } catch (error) {
+      log.error(`Webhook ${url} failed:`, error);
+    }
+  }));
+}